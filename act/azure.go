@@ -0,0 +1,160 @@
+package act
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The upload and download URLs of the cache service v2 are Azure Blob URLs to the toolkit, which
+// talks to them with the Azure Storage SDK. The server implements the subset of the Blob service
+// the SDK uses for caches: Put Blob, Put Block, Put Block List and ranged Get Blob.
+// See https://learn.microsoft.com/en-us/rest/api/storageservices/blob-service-rest-api
+
+const (
+	// azureVersion is the Blob service version the responses claim to follow.
+	azureVersion = "2023-11-03"
+	// azureRangeHeader is sent by the SDK in place of Range.
+	azureRangeHeader = "x-ms-range"
+)
+
+var errInvalidBlockList = errors.New("invalid block list")
+
+// blockList is the body of Put Block List, the blocks are listed in the order of the blob.
+type blockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	// Blocks are Latest, Committed or Uncommitted elements, staged blocks are never committed
+	// before the list so they all name the staged block.
+	Blocks []struct {
+		XMLName xml.Name
+		ID      string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// PUT /_apis/artifactcache/uploads/:id
+//
+// The signed upload URL handed out by CreateCacheEntry. The archive is either uploaded whole with
+// Put Blob, or in blocks with Put Block, which are assembled in order by Put Block List.
+func (h *Handler) routePutBlob(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := h.signer.Verify(r.URL.Path, r.URL.Query()); err != nil {
+		h.azureError(w, r, 403, "AuthenticationFailed", err)
+		return
+	}
+	sc, err := requestScope(r, params)
+	if err != nil {
+		h.azureError(w, r, 400, "InvalidUri", err)
+		return
+	}
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil {
+		h.azureError(w, r, 400, "InvalidUri", err)
+		return
+	}
+	// the upload URL of an ignored save, uploads are made without the token of the job so the
+	// policy was applied when the URL was signed
+	if id == discardID {
+		_, _ = io.Copy(io.Discard, r.Body)
+		h.azureCreated(w, r)
+		return
+	}
+
+	cache, err := h.reservedCache(sc, id)
+	if errors.Is(err, errNotReserved) {
+		h.azureError(w, r, 404, "BlobNotFound", err)
+		return
+	} else if errors.Is(err, errAlreadyComplete) {
+		h.azureError(w, r, 409, "BlobImmutableDueToPolicy", err)
+		return
+	} else if err != nil {
+		h.azureError(w, r, 500, "InternalError", err)
+		return
+	}
+	storage := h.storage.Namespace(cache.Repo)
+
+	query := r.URL.Query()
+	switch query.Get("comp") {
+	case "":
+		// a Put Blob replaces the blob, and drops the blocks staged before
+		err = storage.WriteBlob(cache.ID, r.Body)
+	case "block":
+		blockID := query.Get("blockid")
+		if blockID == "" || len(blockID) > 128 {
+			h.azureError(w, r, 400, "InvalidQueryParameterValue", fmt.Errorf("invalid block id %q", blockID))
+			return
+		}
+		err = storage.WriteBlock(cache.ID, blockID, r.Body)
+	case "blocklist":
+		list := &blockList{}
+		if err := xml.NewDecoder(io.LimitReader(r.Body, 8<<20)).Decode(list); err != nil {
+			h.azureError(w, r, 400, "InvalidXmlDocument", err)
+			return
+		}
+		blockIDs := make([]string, 0, len(list.Blocks))
+		for _, block := range list.Blocks {
+			blockIDs = append(blockIDs, block.ID)
+		}
+		_, err = storage.CommitBlocks(cache.ID, blockIDs)
+		if errors.Is(err, errInvalidBlockList) {
+			h.azureError(w, r, 400, "InvalidBlockList", err)
+			return
+		}
+	default:
+		h.azureError(w, r, 400, "UnsupportedQueryParameter", fmt.Errorf("unsupported comp %q", query.Get("comp")))
+		return
+	}
+	if err != nil {
+		h.azureError(w, r, 500, "InternalError", err)
+		return
+	}
+	h.useCache(id)
+	h.azureCreated(w, r)
+}
+
+// azureCreated answers a Put Blob, Put Block or Put Block List which succeeded.
+func (h *Handler) azureCreated(w http.ResponseWriter, r *http.Request) {
+	h.azureHeaders(w, r)
+	w.Header().Set("ETag", fmt.Sprintf(`"0x%X"`, time.Now().UnixNano()))
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// azureDownload prepares a download to be answered like Get Blob: the range the SDK sends as
+// x-ms-range is turned into a Range, for downloads served with http.ServeContent or passed on to
+// Nexus, and the blob is described as a block blob.
+func (h *Handler) azureDownload(w http.ResponseWriter, r *http.Request) {
+	if v := r.Header.Get(azureRangeHeader); v != "" && r.Header.Get("Range") == "" {
+		r.Header.Set("Range", v)
+	}
+	h.azureHeaders(w, r)
+	w.Header().Set("x-ms-blob-type", "BlockBlob")
+}
+
+// azureHeaders sets the headers every Blob service response carries.
+func (h *Handler) azureHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("x-ms-version", azureVersion)
+	if v := r.Header.Get("x-ms-client-request-id"); v != "" {
+		w.Header().Set("x-ms-client-request-id", v)
+	}
+	w.Header().Set("x-ms-request-id", strconv.FormatInt(time.Now().UnixNano(), 36))
+}
+
+// azureError responds with a Blob service error.
+func (h *Handler) azureError(w http.ResponseWriter, r *http.Request, code int, errorCode string, err error) {
+	h.logger.Errorf("%v %v: %v", r.Method, r.RequestURI, err)
+	h.azureHeaders(w, r)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", errorCode)
+	w.WriteHeader(code)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: errorCode, Message: err.Error()})
+}
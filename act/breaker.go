@@ -0,0 +1,141 @@
+package act
+
+import (
+	"act-nexus-cache/nexus"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errRemoteUnavailable is returned for the requests to a remote whose breaker is open.
+var errRemoteUnavailable = errors.New("remote unavailable")
+
+// breaker stops the requests to a remote which keeps failing, so that jobs are not held up by
+// timeouts while Nexus is down. It trips after a number of consecutive failures, the remote is
+// passed over while it is open and caches are served locally only, until a probe of the status
+// of Nexus succeeds. A threshold of 0 never trips.
+type breaker struct {
+	threshold int
+	interval  time.Duration
+
+	mu       sync.Mutex
+	open     bool
+	failures int
+	since    time.Time
+	lastErr  error
+}
+
+// breakerStatus is the state of a breaker as reported by the health endpoint.
+type breakerStatus struct {
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+func newBreaker(threshold int, interval time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		interval:  interval,
+		since:     time.Now(),
+	}
+}
+
+// allow reports whether requests may be sent to the remote.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open
+}
+
+// record counts the outcome of a request to the remote, it reports whether the breaker tripped.
+// Answers of Nexus other than server errors show it is up, they reset the count of failures.
+func (b *breaker) record(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isOutage(err) {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	b.lastErr = err
+	if b.open || b.threshold <= 0 || b.failures < b.threshold {
+		return false
+	}
+	b.open = true
+	b.since = time.Now()
+	return true
+}
+
+// reset closes the breaker once the remote recovered, it reports whether the breaker was open.
+func (b *breaker) reset() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return false
+	}
+	b.open = false
+	b.failures = 0
+	b.lastErr = nil
+	b.since = time.Now()
+	return true
+}
+
+func (b *breaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := breakerStatus{State: "closed", Failures: b.failures, Since: b.since}
+	if b.open {
+		status.State = "open"
+	}
+	if b.lastErr != nil {
+		status.LastError = b.lastErr.Error()
+	}
+	return status
+}
+
+// isOutage reports whether an error of a request means the remote is down: it could not be
+// reached, it did not answer in time, or it answered with a server error.
+func isOutage(err error) bool {
+	if err == nil || errors.Is(err, nexus.ErrCacheExists) {
+		return false
+	}
+	var statusErr *nexus.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// probeLoop probes a remote every interval while its breaker is open, until the handler is shut
+// down.
+func (h *Handler) probeLoop(rm *remote) {
+	defer h.pending.Done()
+	ticker := time.NewTicker(rm.breaker.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			if !rm.breaker.allow() {
+				h.probe(rm)
+			}
+		}
+	}
+}
+
+// probe checks the status of a remote, once Nexus is back it closes the breaker and pushes the
+// caches postponed meanwhile.
+func (h *Handler) probe(rm *remote) {
+	if err := rm.nexus.Status(); err != nil {
+		h.logger.Debugf("probe remote %s: %v", rm.name, err)
+		return
+	}
+	since := rm.breaker.status().Since
+	if rm.breaker.reset() {
+		h.logger.Infof("remote %s recovered after %v, serving its caches again", rm.name, time.Since(since).Round(time.Second))
+		h.pushPostponed(rm)
+	}
+}
@@ -0,0 +1,73 @@
+package act
+
+import (
+	"act-nexus-cache/nexus"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// nexusClient builds the HTTP client of a remote from the environment variables of a prefix like
+// NEXUS_. The proxy is taken from HTTPS_PROXY and friends unless <prefix>PROXY is set, direct
+// bypasses any proxy. A CA bundle is trusted in addition to the system roots, and the client
+// certificate is reloaded when its files change.
+func nexusClient(prefix string) (*http.Client, error) {
+	options := nexus.ClientOptions{
+		ConnectTimeout:      envDuration(prefix+"CONNECT_TIMEOUT", 10*time.Second),
+		ResponseTimeout:     envDuration(prefix+"RESPONSE_TIMEOUT", time.Minute),
+		MaxConnsPerHost:     envInt(prefix+"MAX_CONNS", 0),
+		MaxIdleConnsPerHost: envInt(prefix+"MAX_IDLE_CONNS", 16),
+		IdleConnTimeout:     envDuration(prefix+"IDLE_TIMEOUT", 90*time.Second),
+		KeepAlive:           envDuration(prefix+"KEEP_ALIVE", 30*time.Second),
+	}
+
+	switch proxy := os.Getenv(prefix + "PROXY"); proxy {
+	case "":
+	case "direct":
+		options.Proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+	default:
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%sPROXY: %w", prefix, err)
+		}
+		options.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	caFile, certFile, keyFile := os.Getenv(prefix+"CA_FILE"), os.Getenv(prefix+"CLIENT_CERT"), os.Getenv(prefix+"CLIENT_KEY")
+	if caFile != "" || certFile != "" || keyFile != "" {
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", caFile)
+			}
+			config.RootCAs = pool
+		}
+		if certFile != "" || keyFile != "" {
+			if certFile == "" || keyFile == "" {
+				return nil, fmt.Errorf("%sCLIENT_CERT and %sCLIENT_KEY must be set together", prefix, prefix)
+			}
+			reloader, err := newCertReloader(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return reloader.GetCertificate(nil)
+			}
+		}
+		options.TLS = config
+	}
+
+	return nexus.NewClient(options), nil
+}
@@ -0,0 +1,60 @@
+package act
+
+import (
+	"act-nexus-cache/nexus"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// nexusCredentials reads how a remote authorizes from the environment variables of a prefix like
+// NEXUS_. The first source configured is used, in this order: a credential helper command, a
+// credentials file, a user token, a netrc file, and the username and secret. With anonymous reads
+// the credentials only authorize uploads.
+func nexusCredentials(prefix string, endpoint string) (nexus.Credentials, error) {
+	parsedUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials nexus.Credentials
+	switch {
+	case os.Getenv(prefix+"CREDENTIAL_HELPER") != "":
+		credentials = nexus.CredentialHelper(os.Getenv(prefix+"CREDENTIAL_HELPER"), parsedUrl.Scheme, parsedUrl.Host)
+	case os.Getenv(prefix+"CREDENTIALS_FILE") != "":
+		credentials, err = nexus.CredentialsFile(os.Getenv(prefix + "CREDENTIALS_FILE"))
+	case os.Getenv(prefix+"USER_TOKEN") != "":
+		credentials, err = nexus.UserToken(os.Getenv(prefix + "USER_TOKEN"))
+	case os.Getenv(prefix+"NETRC") != "":
+		var path string
+		if path, err = netrcPath(os.Getenv(prefix + "NETRC")); err == nil {
+			credentials, err = nexus.Netrc(path, parsedUrl.Hostname())
+		}
+	default:
+		credentials = nexus.BasicAuth(os.Getenv(prefix+"USERNAME"), os.Getenv(prefix+"SECRET"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("credentials of %s: %w", endpoint, err)
+	}
+
+	if envBool(prefix+"ANONYMOUS_READ", false) {
+		credentials = nexus.AnonymousRead(credentials)
+	}
+	return credentials, nil
+}
+
+// netrcPath returns the netrc file a setting names, true stands for $NETRC or ~/.netrc.
+func netrcPath(setting string) (string, error) {
+	if setting != "true" && setting != "1" {
+		return setting, nil
+	}
+	if path := os.Getenv("NETRC"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".netrc"), nil
+}
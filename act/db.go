@@ -1,10 +1,10 @@
 package act
 
 import (
+	"act-nexus-cache/match"
 	"errors"
 	"fmt"
 	"github.com/timshannon/bolthold"
-	"regexp"
 	"time"
 )
 
@@ -16,68 +16,116 @@ func updateCache(db *bolthold.Store, id uint64, cache *Cache) error {
 	return db.Update(id, cache)
 }
 
+// quarantineCache flags a cache which failed verification, so that lookups skip it.
+// The caches sharing its blob are flagged along with it.
+func quarantineCache(db *bolthold.Store, cache *Cache) error {
+	cache.Quarantined = true
+	if cache.Sha256 == "" {
+		return db.Update(cache.ID, cache)
+	}
+	return db.UpdateMatching(&Cache{},
+		bolthold.Where("Sha256").Eq(cache.Sha256).
+			And("Repo").Eq(cache.Repo),
+		func(record any) error {
+			record.(*Cache).Quarantined = true
+			return nil
+		})
+}
+
+// countBlobRefs counts the caches of a repository which refer to a blob.
+func countBlobRefs(db *bolthold.Store, repo string, digest string) (int, error) {
+	return db.Count(&Cache{},
+		bolthold.Where("Sha256").Eq(digest).
+			And("Repo").Eq(repo))
+}
+
 // this function only used in gc
 func deleteCache(db *bolthold.Store, id uint64, cache *Cache) error {
 	return db.Delete(id, cache)
 }
 
-// findCache searches the cache database for a cache entry that matches the
-func findCache(db *bolthold.Store, keys []string, version string) (*Cache, error) {
-	// Create an empty Cache instance to store the fetched cache, if any.
-	cache := &Cache{}
-
-	// Iterate over all provided keys.
-	for _, prefix := range keys {
-		// Try to find a cache entry where Key and Version fields match with provided key and version respectively.
-		// Query also checks if the cache is complete (Complete field is true).
-		// Results are sorted in reverse order of the CreatedAt field.
-		// So the most recent cache entry is returned if multiple entries are found.
-		if err := db.FindOne(cache,
-			bolthold.Where("Key").Eq(prefix).
-				And("Version").Eq(version).
-				And("Complete").Eq(true).
-				SortBy("CreatedAt").Reverse()); err == nil || !errors.Is(err, bolthold.ErrNotFound) {
-			if err != nil {
-				// If an error occurred and it is not because the entry was not found, return error.
-				return nil, fmt.Errorf("find cache: %w", err)
-			}
-			// Cache entry was found, return it.
-			return cache, nil
-		}
-
-		// If no exact match is found, try to find a cache with Key field matching the prefix of provided key.
-		// Construct a prefix pattern using provided key.
-		prefixPattern := fmt.Sprintf("^%s", regexp.QuoteMeta(prefix))
-
-		// Compile the prefix pattern into a regular expression.
-		re, err := regexp.Compile(prefixPattern)
-		if err != nil {
-			// If an error occurred while compiling pattern (should be rare), skip this key and continue with the next key.
-			continue
-		}
-
-		// Try to find a cache entry where Key field matches the prefix pattern, Version matches the provided version and the cache is complete.
-		if err := db.FindOne(cache,
-			bolthold.Where("Key").RegExp(re).
-				And("Version").Eq(version).
-				And("Complete").Eq(true).
-				SortBy("CreatedAt").Reverse()); err != nil {
-			if errors.Is(err, bolthold.ErrNotFound) {
-				// If the entry was not found, continue with the next key.
-				continue
-			}
-			// If an error occurred and it is not because the entry was not found, return error.
-			return nil, fmt.Errorf("find cache: %w", err)
+// findCache searches the cache database for a cache entry of the repository that matches the
+// provided keys and version.
+//
+// When refs are given, the refs are searched in order and every key is tried on a ref before
+// moving on to the next one, like GitHub restores from the current branch before the base branch.
+// Caches of other refs are never returned. Without refs, only the caches saved without a ref
+// match, like in Nexus.
+func findCache(db *bolthold.Store, repo string, refs []string, keys []string, version string) (*Cache, error) {
+	if len(refs) == 0 {
+		return findCacheInRef(db, repo, "", keys, version)
+	}
+	for _, ref := range refs {
+		cache, err := findCacheInRef(db, repo, ref, keys, version)
+		if err != nil || cache != nil {
+			return cache, err
 		}
+	}
+	return nil, nil
+}
 
-		// Cache entry was found, return it.
-		return cache, nil
+// findCacheInRef searches a single ref for the provided keys.
+// The cache is picked by match.Find, the rule Nexus lookups follow as well.
+func findCacheInRef(db *bolthold.Store, repo string, ref string, keys []string, version string) (*Cache, error) {
+	// Complete caches of the version visible from the repository and ref.
+	query := bolthold.Where("Version").Eq(version).
+		And("Repo").Eq(repo).
+		And("Ref").Eq(ref).
+		And("Complete").Eq(true).
+		And("Quarantined").Eq(false)
+
+	var caches []*Cache
+	if err := db.Find(&caches, query); err != nil {
+		return nil, fmt.Errorf("find cache: %w", err)
 	}
 
+	candidates := make([]match.Candidate, 0, len(caches))
+	for _, cache := range caches {
+		candidates = append(candidates, match.Candidate{
+			Key:     cache.Key,
+			Version: cache.Version,
+			Created: time.Unix(cache.CreatedAt, 0),
+		})
+	}
+	if i := match.Find(keys, version, candidates); i >= 0 {
+		return caches[i], nil
+	}
 	// If no matching cache entry was found for any key, return nil.
 	return nil, nil
 }
 
+// findKeyCaches returns the caches of a key and version in the repository and ref, complete or
+// not, leaving out the quarantined ones which a new cache may replace.
+func findKeyCaches(db *bolthold.Store, repo string, ref string, key string, version string) ([]*Cache, error) {
+	var caches []*Cache
+	if err := db.Find(&caches, bolthold.Where("Key").Eq(key).
+		And("Version").Eq(version).
+		And("Repo").Eq(repo).
+		And("Ref").Eq(ref).
+		And("Quarantined").Eq(false)); err != nil {
+		return nil, fmt.Errorf("find caches: %w", err)
+	}
+	return caches, nil
+}
+
+// findReservedCache returns the latest cache reserved for the key and version in the repository
+// and ref which is not complete yet, or nil when there is none.
+func findReservedCache(db *bolthold.Store, repo string, ref string, key string, version string) (*Cache, error) {
+	cache := &Cache{}
+	err := db.FindOne(cache, bolthold.Where("Key").Eq(key).
+		And("Version").Eq(version).
+		And("Repo").Eq(repo).
+		And("Ref").Eq(ref).
+		And("Complete").Eq(false).
+		SortBy("CreatedAt").Reverse())
+	if errors.Is(err, bolthold.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("find reserved cache: %w", err)
+	}
+	return cache, nil
+}
+
 func insertCache(db *bolthold.Store, cache *Cache) error {
 	if err := db.Insert(bolthold.NextSequence(), cache); err != nil {
 		return fmt.Errorf("insert cache: %w", err)
@@ -91,32 +139,35 @@ func insertCache(db *bolthold.Store, cache *Cache) error {
 
 // gc cache functions
 
-func findIncompleteCaches(db *bolthold.Store, caches []*Cache) error {
+func findIncompleteCaches(db *bolthold.Store) ([]*Cache, error) {
+	var caches []*Cache
 	err := db.Find(&caches, bolthold.
 		Where("UsedAt").Lt(time.Now().Add(-keepTemp).Unix()).
 		And("Complete").Eq(false),
 	)
-	return err
+	return caches, err
 }
 
-func findUnusedCaches(db *bolthold.Store, caches []*Cache) error {
+func findUnusedCaches(db *bolthold.Store) ([]*Cache, error) {
+	var caches []*Cache
 	err := db.Find(&caches, bolthold.
 		Where("UsedAt").Lt(time.Now().Add(-keepUnused).Unix()),
 	)
-	return err
+	return caches, err
 }
 
-func findOldCaches(db *bolthold.Store, caches []*Cache) error {
+func findOldCaches(db *bolthold.Store) ([]*Cache, error) {
+	var caches []*Cache
 	err := db.Find(&caches, bolthold.
 		Where("CreatedAt").Lt(time.Now().Add(-keepUsed).Unix()),
 	)
-	return err
+	return caches, err
 }
 
 func findCompletedCaches(db *bolthold.Store) ([]*bolthold.AggregateResult, error) {
 	return db.FindAggregate(
 		&Cache{},
 		bolthold.Where("Complete").Eq(true),
-		"Key", "Version",
+		"Repo", "Ref", "Key", "Version",
 	)
 }
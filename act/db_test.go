@@ -0,0 +1,90 @@
+package act
+
+import (
+	"act-nexus-cache/match/matchtest"
+	"testing"
+	"time"
+
+	"github.com/timshannon/bolthold"
+)
+
+func openTestDB(t *testing.T) *bolthold.Store {
+	t.Helper()
+	db, err := (&Handler{dir: t.TempDir()}).openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// saveTestCache inserts a complete cache created at the time.
+func saveTestCache(t *testing.T, db *bolthold.Store, repo string, ref string, key string, version string, created time.Time) {
+	t.Helper()
+	cache := &Cache{
+		Repo:      repo,
+		Ref:       ref,
+		Key:       key,
+		Version:   version,
+		Complete:  true,
+		CreatedAt: created.Unix(),
+		UsedAt:    created.Unix(),
+	}
+	if err := insertCache(db, cache); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindCacheMatchCases(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	for _, tc := range matchtest.Cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			db := openTestDB(t)
+			for i, cache := range tc.Caches {
+				saveTestCache(t, db, "acme/app", "", cache.Key, cache.Version, created.Add(time.Duration(i)*time.Second))
+			}
+			cache, err := findCache(db, "acme/app", nil, tc.Keys, tc.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if cache != nil {
+				got = cache.Key
+			}
+			if got != tc.Want {
+				t.Errorf("findCache(%q, %q) = %q, want %q", tc.Keys, tc.Version, got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestFindCacheRefs(t *testing.T) {
+	db := openTestDB(t)
+	created := time.Now().Add(-time.Hour)
+	saveTestCache(t, db, "acme/app", "refs/heads/main", "linux-main", "v1", created)
+	saveTestCache(t, db, "acme/app", "refs/heads/feature", "linux-feature", "v1", created.Add(time.Second))
+	saveTestCache(t, db, "acme/other", "", "linux-other", "v1", created.Add(2*time.Second))
+
+	for _, tc := range []struct {
+		refs []string
+		want string
+	}{
+		{[]string{"refs/heads/feature", "refs/heads/main"}, "linux-feature"},
+		{[]string{"refs/heads/sibling", "refs/heads/main"}, "linux-main"},
+		{[]string{"refs/heads/sibling"}, ""},
+		// without refs only the caches saved without a ref match, like in Nexus
+		{nil, ""},
+	} {
+		cache, err := findCache(db, "acme/app", tc.refs, []string{"linux-"}, "v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if cache != nil {
+			got = cache.Key
+		}
+		if got != tc.want {
+			t.Errorf("refs %q: found %q, want %q", tc.refs, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package act
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted archives are a header followed by chunks sealed with AES-GCM.
+//
+//	header: magic "ANCE" | version | key id length | key id | salt
+//	chunk:  AES-GCM(plaintext of encChunkSize bytes) | tag
+//
+// Every archive is sealed with a key of its own, derived from the key of the id and the random
+// salt with HKDF-SHA256. The nonce of a chunk is the chunk index and a flag marking the final
+// chunk, so that chunks can not be reordered, dropped or truncated without the authentication
+// failing. Every chunk but the final one holds exactly encChunkSize bytes, which keeps chunks
+// addressable for ranged reads.
+const (
+	encMagic        = "ANCE"
+	encVersion      = 1
+	encChunkSize    = 64 * 1024
+	encSaltSize     = 32
+	encNonceSize    = 12
+	encTagSize      = 16
+	encSealedChunk  = encChunkSize + encTagSize
+	encFinalFlag    = 1
+	encMaxKeyIDSize = 255
+	// encKeyInfo binds the keys derived for archives to their use.
+	encKeyInfo = "act-nexus-cache archive"
+)
+
+var errNotEncrypted = errors.New("not encrypted")
+
+// keyring holds the encryption keys by id. Archives are encrypted with the active key,
+// the other keys are kept to decrypt archives written before a rotation.
+type keyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// loadKeyring reads the keys from ACT_CACHE_ENCRYPTION_KEYS, a comma separated list of
+// id=base64 entries holding 16, 24 or 32 byte AES keys. The active key is ACT_CACHE_ENCRYPTION_KEY_ID,
+// or the first key of the list. It returns nil when no key is configured and archives are stored in clear.
+func loadKeyring() (*keyring, error) {
+	value := os.Getenv("ACT_CACHE_ENCRYPTION_KEYS")
+	if value == "" {
+		return nil, nil
+	}
+	k := &keyring{
+		keys: map[string][]byte{},
+	}
+	for _, entry := range strings.Split(value, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || id == "" || len(id) > encMaxKeyIDSize {
+			return nil, fmt.Errorf("invalid encryption key entry %q", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		k.keys[id] = key
+		if k.active == "" {
+			k.active = id
+		}
+	}
+	if id := os.Getenv("ACT_CACHE_ENCRYPTION_KEY_ID"); id != "" {
+		if _, ok := k.keys[id]; !ok {
+			return nil, fmt.Errorf("active encryption key %s is not configured", id)
+		}
+		k.active = id
+	}
+	return k, nil
+}
+
+// encHeader is the parsed header of an encrypted archive.
+type encHeader struct {
+	keyID string
+	salt  []byte
+	size  int64
+}
+
+// chunkNonce returns the nonce of a chunk, zeros followed by its index and the final flag. Nonces
+// repeat across archives, which are sealed with keys of their own.
+func chunkNonce(index uint32, final bool) []byte {
+	nonce := make([]byte, encNonceSize-5, encNonceSize)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if final {
+		return append(nonce, encFinalFlag)
+	}
+	return append(nonce, 0)
+}
+
+func (h *encHeader) marshal() []byte {
+	buf := []byte(encMagic)
+	buf = append(buf, encVersion, byte(len(h.keyID)))
+	buf = append(buf, h.keyID...)
+	return append(buf, h.salt...)
+}
+
+// readEncHeader parses the header at the start of r, it returns errNotEncrypted when r does not start with one.
+func readEncHeader(r io.Reader) (*encHeader, error) {
+	fixed := make([]byte, len(encMagic)+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errNotEncrypted
+		}
+		return nil, err
+	}
+	if string(fixed[:len(encMagic)]) != encMagic {
+		return nil, errNotEncrypted
+	}
+	if fixed[len(encMagic)] != encVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", fixed[len(encMagic)])
+	}
+	rest := make([]byte, int(fixed[len(encMagic)+1])+encSaltSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("read encryption header: %w", err)
+	}
+	return &encHeader{
+		keyID: string(rest[:len(rest)-encSaltSize]),
+		salt:  rest[len(rest)-encSaltSize:],
+		size:  int64(len(fixed) + len(rest)),
+	}, nil
+}
+
+// aead returns the cipher of an archive, with the key derived from the key of its id and its salt.
+func (k *keyring) aead(header *encHeader) (cipher.AEAD, error) {
+	key, ok := k.keys[header.keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %s is not configured", header.keyID)
+	}
+	block, err := aes.NewCipher(archiveKey(key, header.salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// archiveKey derives the key of an archive from a key of the ring and the salt of the archive with
+// HKDF-SHA256 (RFC 5869), of the length of the key of the ring.
+func archiveKey(key []byte, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(encKeyInfo))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:len(key)]
+}
+
+// plainSize returns the plaintext size of an encrypted archive of the given size.
+func plainSize(size int64, header *encHeader) (int64, error) {
+	body := size - header.size
+	full, rem := body/encSealedChunk, body%encSealedChunk
+	if body <= 0 || (rem != 0 && rem < encTagSize) {
+		return 0, fmt.Errorf("truncated encrypted archive")
+	}
+	if rem == 0 {
+		return full * encChunkSize, nil
+	}
+	return full*encChunkSize + rem - encTagSize, nil
+}
+
+// encryptWriter seals the plaintext written to it in chunks, Close seals the final chunk
+// and must be called for the archive to be readable.
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint32
+}
+
+// Encrypt returns a writer encrypting into w with the active key, along with the id of the key.
+func (k *keyring) Encrypt(w io.Writer) (io.WriteCloser, string, error) {
+	header := &encHeader{
+		keyID: k.active,
+		salt:  make([]byte, encSaltSize),
+	}
+	if _, err := rand.Read(header.salt); err != nil {
+		return nil, "", err
+	}
+	aead, err := k.aead(header)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := w.Write(header.marshal()); err != nil {
+		return nil, "", err
+	}
+	return &encryptWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, encChunkSize),
+	}, k.active, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full buffer is only sealed once more data arrives, the final chunk is sealed by Close
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	if e.index == ^uint32(0) {
+		return fmt.Errorf("archive too large to encrypt")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.index, final), e.buf, nil)
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptReader reads the plaintext of an encrypted archive sequentially.
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	buf    []byte
+	sealed []byte
+	index  uint32
+	done   bool
+}
+
+// Decrypt returns a reader of the plaintext of r. When r is not encrypted, the returned
+// reader yields r unchanged and the key id is empty.
+func (k *keyring) Decrypt(r io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReaderSize(r, encSealedChunk)
+	prefix, err := br.Peek(len(encMagic))
+	if err != nil || !bytes.Equal(prefix, []byte(encMagic)) {
+		return br, "", nil
+	}
+	header, err := readEncHeader(br)
+	if err != nil {
+		return nil, "", err
+	}
+	if k == nil {
+		return nil, "", fmt.Errorf("archive is encrypted with key %s, but no key is configured", header.keyID)
+	}
+	aead, err := k.aead(header)
+	if err != nil {
+		return nil, "", err
+	}
+	return &decryptReader{
+		r:      br,
+		aead:   aead,
+		sealed: make([]byte, encSealedChunk),
+	}, header.keyID, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.sealed)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !(errors.Is(err, io.EOF) && n == 0) {
+			return 0, err
+		}
+		// the final chunk is the one not followed by any more data
+		final := n < encSealedChunk
+		if !final {
+			if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+				final = true
+			}
+		}
+		plain, err := d.aead.Open(nil, chunkNonce(d.index, final), d.sealed[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("decrypt chunk %d: %w", d.index, errCorrupt)
+		}
+		d.index++
+		d.buf = plain
+		d.done = final
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// decryptFile is a seekable reader of the plaintext of an encrypted archive on disk,
+// chunks are decrypted on demand so that ranges can be served without decrypting the whole file.
+type decryptFile struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	header *encHeader
+	size   int64
+	chunks int64
+	pos    int64
+
+	cached      []byte
+	cachedIndex int64
+}
+
+// Open returns a seekable reader of the plaintext of the encrypted archive r of the given size,
+// along with the plaintext size and the key id. It returns errNotEncrypted when r is not encrypted.
+func (k *keyring) Open(r io.ReaderAt, size int64) (io.ReadSeeker, int64, string, error) {
+	header, err := readEncHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if k == nil {
+		return nil, 0, "", fmt.Errorf("archive is encrypted with key %s, but no key is configured", header.keyID)
+	}
+	aead, err := k.aead(header)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	plain, err := plainSize(size, header)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return &decryptFile{
+		r:           r,
+		aead:        aead,
+		header:      header,
+		size:        plain,
+		chunks:      (size - header.size + encSealedChunk - 1) / encSealedChunk,
+		cachedIndex: -1,
+	}, plain, header.keyID, nil
+}
+
+func (d *decryptFile) chunk(index int64) ([]byte, error) {
+	if index == d.cachedIndex {
+		return d.cached, nil
+	}
+	sealed := make([]byte, encSealedChunk)
+	n, err := d.r.ReadAt(sealed, d.header.size+index*encSealedChunk)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	plain, err := d.aead.Open(nil, chunkNonce(uint32(index), index == d.chunks-1), sealed[:n], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt chunk %d: %w", index, errCorrupt)
+	}
+	d.cached, d.cachedIndex = plain, index
+	return plain, nil
+}
+
+func (d *decryptFile) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	plain, err := d.chunk(d.pos / encChunkSize)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, plain[d.pos%encChunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	d.pos = offset
+	return offset, nil
+}
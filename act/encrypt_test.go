@@ -0,0 +1,231 @@
+package act
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func testKeyring(ids ...string) *keyring {
+	k := &keyring{active: ids[0], keys: map[string][]byte{}}
+	for i, id := range ids {
+		k.keys[id] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	return k
+}
+
+func encryptBytes(t *testing.T, k *keyring, plain []byte) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, keyID, err := k.Encrypt(&sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != k.active {
+		t.Fatalf("encrypted with key %s, want %s", keyID, k.active)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+// decryptBoth reads the plaintext of an archive with the sequential reader and the seekable file.
+func decryptBoth(k *keyring, sealed []byte) ([]byte, []byte, error) {
+	r, _, err := k.Decrypt(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, nil, err
+	}
+	sequential, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, _, _, err := k.Open(bytes.NewReader(sealed), int64(len(sealed)))
+	if err != nil {
+		return sequential, nil, err
+	}
+	seekable, err := io.ReadAll(f)
+	return sequential, seekable, err
+}
+
+func randomBytes(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b)
+	return b
+}
+
+var encSizes = []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 2 * encChunkSize, 3*encChunkSize + 17}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	k := testKeyring("k1")
+	for _, size := range encSizes {
+		plain := randomBytes(size)
+		sealed := encryptBytes(t, k, plain)
+		sequential, seekable, err := decryptBoth(k, sealed)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(sequential, plain) || !bytes.Equal(seekable, plain) {
+			t.Fatalf("size %d: plaintext differs", size)
+		}
+		header, err := readEncHeader(bytes.NewReader(sealed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := plainSize(int64(len(sealed)), header); err != nil || n != int64(size) {
+			t.Fatalf("size %d: plainSize = %d, %v", size, n, err)
+		}
+	}
+}
+
+func TestEncryptArchiveKeys(t *testing.T) {
+	k := testKeyring("k1")
+	plain := randomBytes(encChunkSize)
+	first, second := encryptBytes(t, k, plain), encryptBytes(t, k, plain)
+	if bytes.Equal(first, second) {
+		t.Fatal("two archives of the same plaintext are equal")
+	}
+	h1, _ := readEncHeader(bytes.NewReader(first))
+	h2, _ := readEncHeader(bytes.NewReader(second))
+	if bytes.Equal(h1.salt, h2.salt) {
+		t.Fatalf("archives share a salt: %x", h1.salt)
+	}
+	if bytes.Equal(archiveKey(k.keys["k1"], h1.salt), k.keys["k1"]) {
+		t.Fatal("the archive key is the key of the ring")
+	}
+}
+
+func TestDecryptRotatedKey(t *testing.T) {
+	old := testKeyring("k1")
+	sealed := encryptBytes(t, old, []byte("before the rotation"))
+	rotated := testKeyring("k2", "k1")
+	rotated.keys["k1"] = old.keys["k1"]
+	if plain, _, err := decryptBoth(rotated, sealed); err != nil || string(plain) != "before the rotation" {
+		t.Fatalf("decrypt = %q, %v", plain, err)
+	}
+	if _, _, err := decryptBoth(testKeyring("k2"), sealed); err == nil {
+		t.Fatal("decrypted without the key")
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	k := testKeyring("k1")
+	sealed := encryptBytes(t, k, randomBytes(3*encChunkSize+17))
+	header, _ := readEncHeader(bytes.NewReader(sealed))
+	for _, size := range []int64{
+		header.size,
+		header.size + encTagSize - 1,
+		header.size + encSealedChunk,   // the final chunk dropped
+		header.size + 3*encSealedChunk, // a full chunk left last
+		int64(len(sealed)) - 1,         // the final chunk cut short
+		header.size + 2*encSealedChunk + 5,
+	} {
+		if _, _, err := decryptBoth(k, sealed[:size]); err == nil {
+			t.Errorf("truncated to %d bytes: no error", size)
+		}
+	}
+}
+
+func TestDecryptReordered(t *testing.T) {
+	k := testKeyring("k1")
+	sealed := encryptBytes(t, k, randomBytes(3*encChunkSize))
+	header, _ := readEncHeader(bytes.NewReader(sealed))
+	swapped := append([]byte(nil), sealed...)
+	first := swapped[header.size : header.size+encSealedChunk]
+	second := swapped[header.size+encSealedChunk : header.size+2*encSealedChunk]
+	tmp := append([]byte(nil), first...)
+	copy(first, second)
+	copy(second, tmp)
+	if _, _, err := decryptBoth(k, swapped); !errors.Is(err, errCorrupt) {
+		t.Fatalf("reordered chunks: %v, want %v", err, errCorrupt)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	k := testKeyring("k1")
+	sealed := encryptBytes(t, k, randomBytes(2*encChunkSize+1))
+	header, _ := readEncHeader(bytes.NewReader(sealed))
+	for _, offset := range []int64{
+		header.size - 1, // the salt
+		header.size,
+		header.size + encChunkSize, // a tag
+		header.size + encSealedChunk + 100,
+		int64(len(sealed)) - 1,
+	} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[offset] ^= 0x01
+		if _, _, err := decryptBoth(k, tampered); !errors.Is(err, errCorrupt) {
+			t.Errorf("byte %d flipped: %v, want %v", offset, err, errCorrupt)
+		}
+	}
+}
+
+func TestDecryptFileSeek(t *testing.T) {
+	k := testKeyring("k1")
+	plain := randomBytes(3*encChunkSize + 17)
+	sealed := encryptBytes(t, k, plain)
+	f, size, _, err := k.Open(bytes.NewReader(sealed), int64(len(sealed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(plain)) {
+		t.Fatalf("size %d, want %d", size, len(plain))
+	}
+
+	r := rand.New(rand.NewSource(1))
+	offsets := []int64{0, encChunkSize - 1, encChunkSize, encChunkSize + 1, size - 1, size}
+	for i := 0; i < 50; i++ {
+		offsets = append(offsets, r.Int63n(size))
+	}
+	for _, offset := range offsets {
+		length := min(int64(r.Intn(2*encChunkSize)), size-offset)
+		for _, whence := range []int{io.SeekStart, io.SeekCurrent, io.SeekEnd} {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			relative := offset
+			if whence == io.SeekEnd {
+				relative = offset - size
+			}
+			if pos, err := f.Seek(relative, whence); err != nil || pos != offset {
+				t.Fatalf("seek %d from %d = %d, %v", relative, whence, pos, err)
+			}
+			got := make([]byte, length)
+			if _, err := io.ReadFull(f, got); err != nil {
+				t.Fatalf("read %d bytes at %d: %v", length, offset, err)
+			}
+			if !bytes.Equal(got, plain[offset:offset+length]) {
+				t.Fatalf("%d bytes at %d differ", length, offset)
+			}
+		}
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read at the end = %d, %v", n, err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("seek before the start: no error")
+	}
+}
+
+func TestDecryptPlain(t *testing.T) {
+	k := testKeyring("k1")
+	plain := []byte("not encrypted")
+	r, keyID, err := k.Decrypt(bytes.NewReader(plain))
+	if err != nil || keyID != "" {
+		t.Fatalf("Decrypt = %q, %v", keyID, err)
+	}
+	if got, _ := io.ReadAll(r); !bytes.Equal(got, plain) {
+		t.Fatalf("read %q, want %q", got, plain)
+	}
+	if _, _, _, err := k.Open(bytes.NewReader(plain), int64(len(plain))); !errors.Is(err, errNotEncrypted) {
+		t.Fatalf("Open = %v, want %v", err, errNotEncrypted)
+	}
+}
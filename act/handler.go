@@ -2,17 +2,20 @@ package act
 
 import (
 	"act-nexus-cache/nexus"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -28,38 +31,72 @@ const (
 	urlBase = "/_apis/artifactcache"
 )
 
+var (
+	errNotReserved     = errors.New("not reserved")
+	errAlreadyComplete = errors.New("already complete")
+	errCacheExists     = errors.New("cache already exists")
+	errReserved        = errors.New("already reserved")
+)
+
 type Handler struct {
 	dir      string
 	storage  *Storage
 	router   *httprouter.Router
 	listener net.Listener
 	server   *http.Server
+	tls      *tls.Config
 	logger   logrus.FieldLogger
-	nexus    *nexus.CacheService
+	remotes  *remotes
+	lookups  *lookupCache
+	policies *policies
+	signer   *urlSigner
+	keys     *keyring
+	fetches  int
+	lease    time.Duration
 	gcing    atomic.Bool
 	gcAt     time.Time
 
+	// pending tracks the work which outlives a request, like remote pushes and gc, Shutdown waits on it.
+	pending sync.WaitGroup
+	// done is closed when the handler shuts down, to stop the background jobs.
+	done     chan struct{}
+	stopOnce sync.Once
+
 	outboundIP string
 }
 
 func StartHandler(dir, outboundIP string, port uint16, logger logrus.FieldLogger) (*Handler, error) {
-	environ := os.Environ()
-	if !slices.Contains(environ, "NEXUS_STORE_ENDPOINT") {
+	if _, ok := os.LookupEnv("NEXUS_STORE_ENDPOINT"); !ok {
 		os.Setenv("NEXUS_STORE_ENDPOINT", "https://nxrm.mobilesolutionworks.com/repository/gh-action-cache/act-nexus-cache")
 	}
 
-	if !slices.Contains(environ, "NEXUS_USERNAME") {
+	if _, ok := os.LookupEnv("NEXUS_USERNAME"); !ok {
 		os.Setenv("NEXUS_USERNAME", "gh")
 	}
 
-	if !slices.Contains(environ, "NEXUS_SECRET") {
+	if _, ok := os.LookupEnv("NEXUS_SECRET"); !ok {
 		os.Setenv("NEXUS_SECRET", "gh")
 	}
 
-	nexusStoreEndpoint := os.Getenv("NEXUS_STORE_ENDPOINT")
-
 	h := &Handler{}
-	h.nexus = nexus.NewCacheService(nexusStoreEndpoint)
+	keys, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	h.keys = keys
+	remotes, err := loadRemotes(keys != nil)
+	if err != nil {
+		return nil, err
+	}
+	h.remotes = remotes
+	policies, err := loadPolicies()
+	if err != nil {
+		return nil, err
+	}
+	h.policies = policies
+	h.lookups = newLookupCache(envDuration("ACT_CACHE_LOOKUP_HIT_TTL", time.Minute), envDuration("ACT_CACHE_LOOKUP_MISS_TTL", 30*time.Second))
+	h.fetches = envInt("NEXUS_DOWNLOAD_CONNECTIONS", 4)
+	h.lease = envDuration("ACT_CACHE_RESERVATION_LEASE", keepTemp)
 
 	if logger == nil {
 		discard := logrus.New()
@@ -82,11 +119,23 @@ func StartHandler(dir, outboundIP string, port uint16, logger logrus.FieldLogger
 
 	h.dir = dir
 
-	storage, err := NewStorage(filepath.Join(dir, "cache"))
+	signer, err := newURLSigner()
+	if err != nil {
+		return nil, err
+	}
+	h.signer = signer
+
+	storage, err := NewStorage(filepath.Join(dir, "cache"), keys)
 	if err != nil {
 		return nil, err
 	}
 	h.storage = storage
+	if err := h.migrateStorage(); err != nil {
+		return nil, err
+	}
+	if err := storage.ClearFetches(); err != nil {
+		return nil, err
+	}
 
 	if outboundIP != "" {
 		h.outboundIP = outboundIP
@@ -97,17 +146,49 @@ func StartHandler(dir, outboundIP string, port uint16, logger logrus.FieldLogger
 	}
 
 	router := httprouter.New()
-	router.GET(urlBase+"/cache", h.middleware(h.routeFind))
-	router.POST(urlBase+"/caches", h.middleware(h.routeReserve))
-	router.PATCH(urlBase+"/caches/:id", h.middleware(h.routeUpload))
-	router.POST(urlBase+"/caches/:id", h.middleware(h.routeCommit))
-	router.GET(urlBase+"/artifacts/:id", h.middleware(h.routeGet))
-	router.POST(urlBase+"/clean", h.middleware(h.routeClean))
+	// every route is also served under /repos/:owner/:repo for runners that scope by URL
+	for _, base := range []string{urlBase, repoBase + urlBase} {
+		router.GET(base+"/cache", h.middleware(h.routeFind))
+		router.POST(base+"/caches", h.middleware(h.routeReserve))
+		router.PATCH(base+"/caches/:id", h.middleware(h.routeUpload))
+		router.POST(base+"/caches/:id", h.middleware(h.routeCommit))
+		router.GET(base+"/artifacts/:id", h.middleware(h.routeGet))
+		router.HEAD(base+"/artifacts/:id", h.middleware(h.routeGet))
+		router.GET(base+"/remote/:remote/*path", h.middleware(h.routeRemote))
+		router.HEAD(base+"/remote/:remote/*path", h.middleware(h.routeRemote))
+		router.PUT(base+"/uploads/:id", h.middleware(h.routePutBlob))
+		router.POST(base+"/clean", h.middleware(h.routeClean))
+	}
+	for _, base := range []string{"", repoBase} {
+		router.POST(base+twirpBase+"/CreateCacheEntry", h.middleware(h.routeCreateCacheEntry))
+		router.POST(base+twirpBase+"/FinalizeCacheEntryUpload", h.middleware(h.routeFinalizeCacheEntryUpload))
+		router.POST(base+twirpBase+"/GetCacheEntryDownloadURL", h.middleware(h.routeGetCacheEntryDownloadURL))
+	}
+
+	router.GET("/healthz", h.routeHealth)
 
 	h.router = router
 
 	h.gcCache()
 
+	h.done = make(chan struct{})
+	if interval := envDuration("ACT_CACHE_SCRUB_INTERVAL", 0); interval > 0 {
+		h.pending.Add(1)
+		go h.scrubLoop(interval)
+	}
+	for _, rm := range h.remotes.list {
+		if rm.breaker.threshold > 0 && rm.breaker.interval > 0 {
+			h.pending.Add(1)
+			go h.probeLoop(rm)
+		}
+	}
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	h.tls = tlsConfig
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port)) // listen on all interfaces
 	if err != nil {
 		return nil, err
@@ -115,6 +196,7 @@ func StartHandler(dir, outboundIP string, port uint16, logger logrus.FieldLogger
 	server := &http.Server{
 		ReadHeaderTimeout: 2 * time.Second,
 		Handler:           router,
+		TLSConfig:         tlsConfig,
 	}
 	//go func() {
 	//	if err := server.Serve(listener); err != nil && errors.Is(err, net.ErrClosed) {
@@ -127,23 +209,82 @@ func StartHandler(dir, outboundIP string, port uint16, logger logrus.FieldLogger
 	return h, nil
 }
 
-func (h *Handler) Serve() {
-	if err := h.server.Serve(h.listener); err != nil && errors.Is(err, net.ErrClosed) {
+// Serve blocks until the server is closed or shut down, which is not reported as an error.
+func (h *Handler) Serve() error {
+	var err error
+	if h.tls != nil {
+		// the certificate comes from the TLS config
+		err = h.server.ServeTLS(h.listener, "", "")
+	} else {
+		err = h.server.Serve(h.listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
 		h.logger.Errorf("http serve: %v", err)
+		return err
 	}
+	return nil
 }
 
 func (h *Handler) ExternalURL() string {
 	// TODO: make the external url configurable if necessary
-	return fmt.Sprintf("http://%s:%d",
+	scheme := "http"
+	if h.tls != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d",
+		scheme,
 		h.outboundIP,
 		h.listener.Addr().(*net.TCPAddr).Port)
 }
 
+// Shutdown stops accepting requests and waits, until the context is done, for the in-flight
+// uploads and downloads to finish and for the queued remote pushes to complete, then flushes the
+// database. Unlike Close, nothing is cut off mid-stream unless the context expires first.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	if h == nil || h.server == nil {
+		return nil
+	}
+	h.stop()
+	if err := h.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("drain requests: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("drain remote pushes: %w", ctx.Err())
+	}
+
+	db, err := h.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Bolt().Sync(); err != nil {
+		return fmt.Errorf("flush db: %w", err)
+	}
+	return nil
+}
+
+// stop signals the background jobs to stop.
+func (h *Handler) stop() {
+	h.stopOnce.Do(func() {
+		if h.done != nil {
+			close(h.done)
+		}
+	})
+}
+
 func (h *Handler) Close() error {
 	if h == nil {
 		return nil
 	}
+	h.stop()
 	var retErr error
 	if h.server != nil {
 		err := h.server.Close()
@@ -178,135 +319,218 @@ func (h *Handler) openDB() (*bolthold.Store, error) {
 }
 
 // GET /_apis/artifactcache/cache
-func (h *Handler) routeFind(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (h *Handler) routeFind(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	sc, err := requestScope(r, params)
+	if err != nil {
+		h.responseJSON(w, r, 400, err)
+		return
+	}
+	if !h.policies.of(r).restore {
+		if h.policies.ignore {
+			h.responseJSON(w, r, 204)
+		} else {
+			h.responseJSON(w, r, 403, errRestoreDenied)
+		}
+		return
+	}
+
 	// Splitting cache keys gotten from URL
 	keys := strings.Split(r.URL.Query().Get("keys"), ",")
+	// Finding version from URL
+	version := r.URL.Query().Get("version")
+
+	location, key, err := h.lookup(sc, keys, version)
+	if err != nil {
+		// Error fetching cache - send 500 error
+		h.responseJSON(w, r, 500, err)
+		return
+	}
+	if location == "" {
+		// Cache not found - send 204 status
+		h.responseJSON(w, r, 204)
+		return
+	}
+	h.responseJSON(w, r, 200, map[string]any{
+		"result":          "hit",
+		"archiveLocation": location,
+		"cacheKey":        key,
+	})
+}
+
+// lookup finds the cache matching the keys in the scope. The refs of the scope are searched in
+// order, each locally then in Nexus, so a cache of the ref of the job wins over the caches of the
+// refs it restores from wherever they are stored. It returns the signed location of the archive
+// and the key which matched, or an empty location on a miss.
+func (h *Handler) lookup(sc *scope, keys []string, version string) (string, string, error) {
 	// Cache keys are case insensitive
 	for i, key := range keys {
 		keys[i] = strings.ToLower(key)
 	}
-	// Finding version from URL
-	version := r.URL.Query().Get("version")
 
 	// Attempt to open database
 	db, err := h.openDB()
 	if err != nil {
-		// Error opening DB - send 500 error
-		h.responseJSON(w, r, 500, err)
-		return
+		return "", "", err
 	}
 	defer db.Close()
 
-	nexusCache, err := h.nexus.FindCache(keys, version)
-	if nexusCache != nil {
-		h.responseJSON(w, r, 200, map[string]any{
-			"result":          "hit",
-			"archiveLocation": nexusCache.ArchiveLocation,
-			"cacheKey":        nexusCache.CacheKey,
-		})
-		return
+	// without refs, only the caches saved without a ref are searched
+	refLists := [][]string{nil}
+	if refs := sc.lookupRefs(); len(refs) > 0 {
+		refLists = refLists[:0]
+		for _, ref := range refs {
+			refLists = append(refLists, []string{ref})
+		}
+	}
+	for _, refs := range refLists {
+		cache, err := findCache(db, sc.Repo, refs, keys, version)
+		if err != nil {
+			return "", "", err
+		}
+		if cache != nil {
+			// Cache found, check if it actually exists in storage
+			if ok, err := h.storage.Namespace(cache.Repo).Exist(cache.Sha256); err != nil {
+				return "", "", err
+			} else if ok {
+				return h.signedURL(fmt.Sprintf("%s/artifacts/%d", repoURLBase(sc.Repo), cache.ID)), cache.Key, nil
+			}
+			// Cache does not exist in storage - delete the cache from DB
+			_ = db.Delete(cache.ID, cache)
+		}
+
+		if rm, nexusCache := h.findRemote(sc.Repo, refs, keys, version); nexusCache != nil {
+			// Nexus hits are proxied, so that they are signed like local hits
+			return h.signedURL(fmt.Sprintf("%s/remote/%s/%s", repoURLBase(sc.Repo), rm.name, nexusCache.Path)), nexusCache.CacheKey, nil
+		}
 	}
+	return "", "", nil
+}
 
-	// Attempt to find cache in db
-	cache, err := findCache(db, keys, version)
+// POST /_apis/artifactcache/caches
+func (h *Handler) routeReserve(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	sc, err := requestScope(r, params)
 	if err != nil {
-		// Error fetching cache - send 500 error
-		h.responseJSON(w, r, 500, err)
+		h.responseJSON(w, r, 400, err)
 		return
 	}
-	if cache == nil {
-		// Cache not found - send 204 status
-		h.responseJSON(w, r, 204)
+	if !h.policies.of(r).save {
+		if h.policies.ignore {
+			h.responseJSON(w, r, 200, map[string]any{
+				"cacheId": discardID,
+			})
+		} else {
+			h.responseJSON(w, r, 403, errSaveDenied)
+		}
 		return
 	}
 
-	// Cache found, check if it actually exists in storage
-	if ok, err := h.storage.Exist(cache.ID); err != nil {
-		// Error checking cache existence - send 500 error
-		h.responseJSON(w, r, 500, err)
+	api := &Request{}
+	if err := json.NewDecoder(r.Body).Decode(api); err != nil {
+		h.responseJSON(w, r, 400, err)
 		return
-	} else if !ok {
-		// Cache does not exist in storage - delete the cache from DB and send 204 status
-		_ = db.Delete(cache.ID, cache)
-		h.responseJSON(w, r, 204)
+	}
+
+	cache, err := h.reserve(sc, api)
+	if errors.Is(err, errCacheExists) || errors.Is(err, errReserved) {
+		h.responseJSON(w, r, 409, err)
+		return
+	} else if err != nil {
+		h.responseJSON(w, r, 500, err)
 		return
 	}
 
-	// TODO Cache found and exists in storage, return cache details
+	// TODO return response
 	h.responseJSON(w, r, 200, map[string]any{
-		"result":          "hit",
-		"archiveLocation": fmt.Sprintf("%s%s/artifacts/%d", h.ExternalURL(), urlBase, cache.ID),
-		"cacheKey":        cache.Key,
+		"cacheId": cache.ID,
 	})
 }
 
-// POST /_apis/artifactcache/caches
-func (h *Handler) routeReserve(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	api := &Request{}
-	if err := json.NewDecoder(r.Body).Decode(api); err != nil {
-		h.responseJSON(w, r, 400, err)
-		return
-	}
+// reserve creates the cache of a request in the scope, ready for upload. Keys are immutable like on
+// GitHub: a key and version which is already saved, in Nexus or locally, or being uploaded under a
+// reservation whose lease has not expired, cannot be reserved again. The lease of a reservation is
+// renewed by every upload to it, a reservation whose uploader is gone is dropped.
+func (h *Handler) reserve(sc *scope, api *Request) (*Cache, error) {
 	// cache keys are case insensitive
 	api.Key = strings.ToLower(api.Key)
 
+	// keys are immutable in the remote commits are pushed to, unless it is unavailable
+	if write := h.remotes.write; write.breaker.allow() {
+		nexusCache, err := write.nexus.FindCache(sc.Repo, []string{sc.Ref}, []string{api.Key}, api.Version)
+		write.record(h.logger, err)
+		if err != nil {
+			h.logger.Warnf("find cache %q in remote %s: %v", api.Key, write.name, err)
+		} else if nexusCache != nil && nexusCache.CacheKey == api.Key {
+			// lookups fall back to a prefix match, only the key itself conflicts
+			return nil, fmt.Errorf("cache %q: %w", api.Key, errCacheExists)
+		}
+	}
+
 	cache := api.ToCache()
+	cache.Repo = sc.Repo
+	cache.Ref = sc.Ref
 	db, err := h.openDB()
 	if err != nil {
-		h.responseJSON(w, r, 500, err)
-		return
+		return nil, err
 	}
 	defer db.Close()
 
+	existing, err := findKeyCaches(db, cache.Repo, cache.Ref, cache.Key, cache.Version)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range existing {
+		if other.Complete {
+			return nil, fmt.Errorf("cache %q: %w", cache.Key, errCacheExists)
+		}
+		if time.Since(time.Unix(other.UsedAt, 0)) < h.lease {
+			return nil, fmt.Errorf("cache %q: %w by cache %d", cache.Key, errReserved, other.ID)
+		}
+		h.logger.Infof("reservation of cache %d %q expired", other.ID, other.Key)
+		if err := h.removeCache(db, other); err != nil {
+			return nil, err
+		}
+	}
+
 	now := time.Now().Unix()
 	cache.CreatedAt = now
 	cache.UsedAt = now
 	if err := insertCache(db, cache); err != nil {
-		h.responseJSON(w, r, 500, err)
-		return
+		return nil, err
 	}
-
-	// TODO return response
-	h.responseJSON(w, r, 200, map[string]any{
-		"cacheId": cache.ID,
-	})
+	return cache, nil
 }
 
 // PATCH /_apis/artifactcache/caches/:id
 func (h *Handler) routeUpload(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	sc, err := requestScope(r, params)
 	if err != nil {
 		h.responseJSON(w, r, 400, err)
 		return
 	}
-
-	cache := &Cache{}
-	db, err := h.openDB()
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
 	if err != nil {
-		h.responseJSON(w, r, 500, err)
+		h.responseJSON(w, r, 400, err)
 		return
 	}
-	defer db.Close()
-	if err := getCache(db, id, cache); err != nil {
-		if errors.Is(err, bolthold.ErrNotFound) {
-			h.responseJSON(w, r, 400, fmt.Errorf("cache %d: not reserved", id))
-			return
-		}
-		h.responseJSON(w, r, 500, err)
+	if !h.policies.of(r).save || id == discardID {
+		h.denySave(w, r)
 		return
 	}
 
-	if cache.Complete {
-		h.responseJSON(w, r, 400, fmt.Errorf("cache %v %q: already complete", cache.ID, cache.Key))
+	cache, err := h.reservedCache(sc, id)
+	if errors.Is(err, errNotReserved) || errors.Is(err, errAlreadyComplete) {
+		h.responseJSON(w, r, 400, err)
+		return
+	} else if err != nil {
+		h.responseJSON(w, r, 500, err)
 		return
 	}
-	db.Close()
 	start, _, err := parseContentRange(r.Header.Get("Content-Range"))
 	if err != nil {
 		h.responseJSON(w, r, 400, err)
 		return
 	}
-	if err := h.storage.Write(cache.ID, start, r.Body); err != nil {
+	if err := h.storage.Namespace(cache.Repo).Write(cache.ID, start, r.Body); err != nil {
 		h.responseJSON(w, r, 500, err)
 	}
 	h.useCache(id)
@@ -315,71 +539,243 @@ func (h *Handler) routeUpload(w http.ResponseWriter, r *http.Request, params htt
 
 // POST /_apis/artifactcache/caches/:id
 func (h *Handler) routeCommit(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	sc, err := requestScope(r, params)
+	if err != nil {
+		h.responseJSON(w, r, 400, err)
+		return
+	}
 	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
 	if err != nil {
 		h.responseJSON(w, r, 400, err)
 		return
 	}
+	policy := h.policies.of(r)
+	if !policy.save || id == discardID {
+		h.denySave(w, r)
+		return
+	}
+
+	cache, err := h.reservedCache(sc, id)
+	if errors.Is(err, errNotReserved) || errors.Is(err, errAlreadyComplete) {
+		h.responseJSON(w, r, 400, err)
+		return
+	} else if err != nil {
+		h.responseJSON(w, r, 500, err)
+		return
+	}
+
+	if err := h.commit(cache, policy.push); err != nil {
+		h.responseJSON(w, r, 500, err)
+		return
+	}
+	h.responseJSON(w, r, 200)
+}
+
+// denySave answers an upload or a commit the policy does not allow, or one to the reservation of
+// an ignored save, whose content is dropped.
+func (h *Handler) denySave(w http.ResponseWriter, r *http.Request) {
+	if !h.policies.ignore {
+		h.responseJSON(w, r, 403, errSaveDenied)
+		return
+	}
+	_, _ = io.Copy(io.Discard, r.Body)
+	h.responseJSON(w, r, 200)
+}
 
+// reservedCache returns the cache reserved with the id in the scope, as long as it is not complete.
+func (h *Handler) reservedCache(sc *scope, id int64) (*Cache, error) {
 	cache := &Cache{}
 	db, err := h.openDB()
 	if err != nil {
-		h.responseJSON(w, r, 500, err)
-		return
+		return nil, err
 	}
 	defer db.Close()
 	if err := getCache(db, id, cache); err != nil {
 		if errors.Is(err, bolthold.ErrNotFound) {
-			h.responseJSON(w, r, 400, fmt.Errorf("cache %d: not reserved", id))
-			return
+			return nil, fmt.Errorf("cache %d: %w", id, errNotReserved)
 		}
-		h.responseJSON(w, r, 500, err)
-		return
+		return nil, err
+	}
+	if cache.Repo != sc.Repo {
+		// caches of other repositories are invisible, as if they were never reserved
+		return nil, fmt.Errorf("cache %d: %w", id, errNotReserved)
 	}
 
 	if cache.Complete {
-		h.responseJSON(w, r, 400, fmt.Errorf("cache %v %q: already complete", cache.ID, cache.Key))
-		return
+		return nil, fmt.Errorf("cache %v %q: %w", cache.ID, cache.Key, errAlreadyComplete)
 	}
+	return cache, nil
+}
 
-	db.Close()
-
-	size, err := h.storage.Commit(cache.ID, cache.Size)
+// commit assembles the uploaded archive of a cache, completes the cache and pushes it to Nexus.
+func (h *Handler) commit(cache *Cache, push bool) error {
+	storage := h.storage.Namespace(cache.Repo)
+	archive, err := storage.Commit(cache.ID, cache.Size)
 	if err != nil {
-		h.responseJSON(w, r, 500, err)
-		return
+		return err
 	}
 	// write real size back to cache, it may be different from the current value when the request doesn't specify it.
-	cache.Size = size
+	cache.Size = archive.Size
+	cache.KeyID = archive.KeyID
+	cache.Sha256 = archive.Sha256
 
-	db, err = h.openDB()
+	db, err := h.openDB()
 	if err != nil {
-		h.responseJSON(w, r, 500, err)
-		return
+		return err
 	}
 	defer db.Close()
 
 	cache.Complete = true
 	if err := updateCache(db, cache.ID, cache); err != nil {
-		h.responseJSON(w, r, 500, err)
-		return
+		return err
 	}
+	h.lookups.invalidate(cache.Repo, cache.Key, cache.Version)
 
-	filename := h.storage.Filename(cache.ID)
-	h.nexus.PutCache(cache.Key, cache.Version, filename)
-
-	h.responseJSON(w, r, 200)
+	if !push {
+		h.logger.Debugf("cache %d %q is saved locally only by the policy", cache.ID, cache.Key)
+		return nil
+	}
+	h.pushRemote(cache, storage.BlobName(cache.Sha256))
+	return nil
 }
 
 // GET /_apis/artifactcache/artifacts/:id
 func (h *Handler) routeGet(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := h.signer.Verify(r.URL.Path, r.URL.Query()); err != nil {
+		h.responseJSON(w, r, 403, err)
+		return
+	}
+	sc, err := requestScope(r, params)
+	if err != nil {
+		h.responseJSON(w, r, 400, err)
+		return
+	}
 	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
 	if err != nil {
 		h.responseJSON(w, r, 400, err)
 		return
 	}
+	h.azureDownload(w, r)
+
+	cache := &Cache{}
+	db, err := h.openDB()
+	if err != nil {
+		h.responseJSON(w, r, 500, err)
+		return
+	}
+	err = getCache(db, id, cache)
+	db.Close()
+	if err != nil && !errors.Is(err, bolthold.ErrNotFound) {
+		h.responseJSON(w, r, 500, err)
+		return
+	}
+	if err != nil || cache.Repo != sc.Repo {
+		h.responseJSON(w, r, 404, fmt.Errorf("cache %d: not found", id))
+		return
+	}
+
 	h.useCache(id) // update cache time for retention
-	h.storage.Serve(w, r, uint64(id))
+	if err := h.storage.Namespace(cache.Repo).Serve(w, r, cache.Sha256); errors.Is(err, errCorrupt) {
+		h.quarantine(cache)
+	} else if err != nil {
+		h.logger.Warnf("serve cache %d: %v", cache.ID, err)
+	}
+}
+
+// GET /_apis/artifactcache/remote/:remote/*path
+func (h *Handler) routeRemote(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := h.signer.Verify(r.URL.Path, r.URL.Query()); err != nil {
+		h.responseJSON(w, r, 403, err)
+		return
+	}
+	rm := h.remotes.get(params.ByName("remote"))
+	if rm == nil {
+		h.responseJSON(w, r, 404, fmt.Errorf("%s: %w", params.ByName("remote"), errUnknownRemote))
+		return
+	}
+	if !rm.breaker.allow() {
+		h.responseJSON(w, r, 503, fmt.Errorf("%s: %w", rm.name, errRemoteUnavailable))
+		return
+	}
+
+	h.azureDownload(w, r)
+	path := strings.TrimPrefix(params.ByName("path"), "/")
+	// ranges of encrypted archives do not map onto the remote object, they are served from the
+	// archive fetched whole and decrypted
+	if h.keys != nil || r.Header.Get("Range") == "" && r.Method == http.MethodGet && h.fetches > 1 {
+		h.serveFetch(w, r, rm, path)
+		return
+	}
+
+	object, err := rm.nexus.Open(path, r.Header.Get("Range"))
+	if err == nil && object.StatusCode >= 500 {
+		rm.record(h.logger, &nexus.StatusError{Op: "open " + path, StatusCode: object.StatusCode})
+	} else {
+		rm.record(h.logger, err)
+	}
+	if err != nil {
+		h.responseJSON(w, r, 502, err)
+		return
+	}
+	defer object.Body.Close()
+
+	// without keys, an encrypted archive fails here rather than being served sealed
+	body, _, err := h.keys.Decrypt(object.Body)
+	if err != nil {
+		h.responseJSON(w, r, 500, err)
+		return
+	}
+
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified"} {
+		if v := object.Header.Get(header); v != "" {
+			w.Header().Set(header, v)
+		}
+	}
+
+	var verifier *verifyReader
+	if object.StatusCode == http.StatusOK && object.Sha256 != "" {
+		verifier = newVerifyReader(body, object.Sha256)
+		body = verifier
+	}
+
+	w.WriteHeader(object.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		h.logger.Warnf("proxy %s: %v", path, err)
+	}
+	if verifier != nil && verifier.Corrupt() {
+		h.quarantineRemote(rm, path)
+	}
+}
+
+// serveFetch fetches an archive of the remote tier with parallel range requests into a local file,
+// then serves it like a local archive. Connections to Nexus are often limited in bandwidth each,
+// so a large archive arrives sooner over several of them than streamed through one.
+func (h *Handler) serveFetch(w http.ResponseWriter, r *http.Request, rm *remote, path string) {
+	file, err := h.storage.CreateFetch()
+	if err != nil {
+		h.responseJSON(w, r, 500, err)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	result, err := rm.nexus.Fetch(path, file, h.fetches)
+	rm.record(h.logger, err)
+	if err != nil {
+		h.responseJSON(w, r, 502, err)
+		return
+	}
+	h.logger.Infof("fetched %s from remote %s: %d bytes in %v, %.1f MiB/s over %d connections, %d retries",
+		path, rm.name, result.Size, result.Elapsed.Round(time.Millisecond), result.Throughput()/(1<<20), h.fetches, result.Retries)
+
+	if err := h.storage.ServeFetch(w, r, file, result.Sha256); errors.Is(err, errCorrupt) {
+		h.quarantineRemote(rm, path)
+	} else if err != nil {
+		h.logger.Warnf("serve %s: %v", path, err)
+	}
 }
 
 // POST /_apis/artifactcache/clean
@@ -390,14 +786,195 @@ func (h *Handler) routeClean(w http.ResponseWriter, r *http.Request, _ httproute
 	h.responseJSON(w, r, 200)
 }
 
+// GET /healthz
+// The server keeps serving local caches while remotes are unavailable, it is degraded then
+// rather than down.
+func (h *Handler) routeHealth(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	type remoteHealth struct {
+		Name string `json:"name"`
+		breakerStatus
+	}
+	status := "ok"
+	remotes := make([]remoteHealth, 0, len(h.remotes.list))
+	for _, rm := range h.remotes.list {
+		health := remoteHealth{Name: rm.name, breakerStatus: rm.breaker.status()}
+		if health.State == "open" {
+			status = "degraded"
+		}
+		remotes = append(remotes, health)
+	}
+	h.responseJSON(w, r, 200, map[string]any{
+		"status":      status,
+		"writeRemote": h.remotes.write.name,
+		"remotes":     remotes,
+	})
+}
+
+// signedURL returns the external URL of the unescaped path, signed for downloads.
+func (h *Handler) signedURL(path string) string {
+	return fmt.Sprintf("%s%s?%s", h.ExternalURL(), (&url.URL{Path: path}).EscapedPath(), h.signer.Sign(path))
+}
+
 func (h *Handler) middleware(handler httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		h.logger.Debugf("%s %s", r.Method, r.RequestURI)
 		handler(w, r, params)
-		go h.gcCache()
+		h.pending.Add(1)
+		go func() {
+			defer h.pending.Done()
+			h.gcCache()
+		}()
 	}
 }
 
+// quarantine flags a cache whose file does not match its digest, it is no longer returned by lookups.
+func (h *Handler) quarantine(cache *Cache) {
+	h.logger.Errorf("quarantined cache %d %q: %v", cache.ID, cache.Key, errCorrupt)
+	db, err := h.openDB()
+	if err != nil {
+		h.logger.Warnf("quarantine cache %d: %v", cache.ID, err)
+		return
+	}
+	defer db.Close()
+	if err := quarantineCache(db, cache); err != nil {
+		h.logger.Warnf("quarantine cache %d: %v", cache.ID, err)
+	}
+	if err := h.storage.Namespace(cache.Repo).Quarantine(cache.Sha256); err != nil {
+		h.logger.Warnf("quarantine cache %d: %v", cache.ID, err)
+	}
+}
+
+// findRemote looks the keys up in the remote tier, answering from the lookup cache when the same
+// lookup was made a moment ago. Answers are only remembered when every remote asked answered.
+func (h *Handler) findRemote(namespace string, refs []string, keys []string, version string) (*remote, *nexus.Cache) {
+	key := newLookupKey(namespace, refs, keys, version)
+	if rm, cache, ok := h.lookups.get(key); ok {
+		h.logger.Debugf("lookup of %q answered from the lookup cache", keys)
+		return rm, cache
+	}
+	rm, cache, err := h.remotes.find(h.logger, namespace, refs, keys, version)
+	if err == nil {
+		h.lookups.put(key, keys, rm, cache)
+	}
+	return rm, cache
+}
+
+// quarantineRemote hides an asset of a remote which failed verification from lookups.
+func (h *Handler) quarantineRemote(rm *remote, path string) {
+	h.logger.Errorf("quarantined asset %s of remote %s: %v", path, rm.name, errCorrupt)
+	if err := rm.nexus.Quarantine(path); err != nil {
+		// still hidden from the lookups of this instance
+		h.logger.Warnf("mark asset %s of remote %s quarantined: %v", path, rm.name, err)
+	}
+	h.lookups.forget(rm, path)
+}
+
+// pushRemote uploads a committed cache to the write remote in the background, so that the job
+// does not wait on it, and replicates it to the other remotes when enabled. Shutdown waits for
+// the queued pushes.
+func (h *Handler) pushRemote(cache *Cache, filename string) {
+	h.pending.Add(1)
+	go func() {
+		defer h.pending.Done()
+		if h.pushTo(h.remotes.write, cache, filename) {
+			h.replicate(cache, filename)
+		}
+	}()
+}
+
+// replicate uploads a cache the write remote has to the other remotes when replicating.
+func (h *Handler) replicate(cache *Cache, filename string) {
+	if !h.remotes.replicate {
+		return
+	}
+	for _, rm := range h.remotes.list {
+		if rm == h.remotes.write {
+			continue
+		}
+		h.pending.Add(1)
+		go func(rm *remote) {
+			defer h.pending.Done()
+			h.pushTo(rm, cache, filename)
+		}(rm)
+	}
+}
+
+// pushTo uploads a committed cache to a remote, it reports whether the remote has the cache. The
+// push is postponed until the remote recovers when it is unavailable, the cache stays local only
+// meanwhile.
+func (h *Handler) pushTo(rm *remote, cache *Cache, filename string) bool {
+	if !rm.breaker.allow() {
+		h.logger.Warnf("push cache %d %q to remote %s: %v, postponed", cache.ID, cache.Key, rm.name, errRemoteUnavailable)
+		rm.postpone(cache.ID)
+		return false
+	}
+	err := rm.nexus.PutCache(cache.Repo, cache.Ref, cache.Key, cache.Version, filename, cache.Sha256)
+	rm.record(h.logger, err)
+	if errors.Is(err, nexus.ErrCacheExists) {
+		h.logger.Infof("cache %d %q is already in remote %s", cache.ID, cache.Key, rm.name)
+		return true
+	} else if err != nil && !rm.breaker.allow() {
+		// the failure tripped the breaker, or the push raced with the failures which did
+		h.logger.Warnf("push cache %d %q to remote %s: %v, postponed", cache.ID, cache.Key, rm.name, err)
+		rm.postpone(cache.ID)
+		return false
+	} else if err != nil {
+		h.logger.Warnf("push cache %d %q to remote %s: %v", cache.ID, cache.Key, rm.name, err)
+		return false
+	}
+	// lookups made while the push was under way did not see it
+	h.lookups.invalidate(cache.Repo, cache.Key, cache.Version)
+	h.logger.Debugf("pushed cache %d %q to remote %s", cache.ID, cache.Key, rm.name)
+	return true
+}
+
+// pushPostponed retries the pushes to a remote which were postponed while it was unavailable.
+// Caches removed meanwhile are skipped, the pushes left are postponed again if the remote fails
+// anew.
+func (h *Handler) pushPostponed(rm *remote) {
+	ids := rm.takePostponed()
+	if len(ids) == 0 {
+		return
+	}
+	h.logger.Infof("pushing %d caches postponed while remote %s was unavailable", len(ids), rm.name)
+	for i, id := range ids {
+		select {
+		case <-h.done:
+			for _, id := range ids[i:] {
+				rm.postpone(id)
+			}
+			return
+		default:
+		}
+		cache, err := h.postponedCache(id)
+		if err != nil {
+			h.logger.Debugf("skip postponed push of cache %d to remote %s: %v", id, rm.name, err)
+			continue
+		}
+		filename := h.storage.Namespace(cache.Repo).BlobName(cache.Sha256)
+		if h.pushTo(rm, cache, filename) && rm == h.remotes.write {
+			h.replicate(cache, filename)
+		}
+	}
+}
+
+// postponedCache returns the cache of a postponed push, if it is still complete.
+func (h *Handler) postponedCache(id uint64) (*Cache, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	cache := &Cache{}
+	if err := getCache(db, int64(id), cache); err != nil {
+		return nil, err
+	}
+	if !cache.Complete {
+		return nil, fmt.Errorf("cache %d is not complete", id)
+	}
+	return cache, nil
+}
+
 func (h *Handler) useCache(id int64) {
 	db, err := h.openDB()
 	if err != nil {
@@ -443,13 +1020,12 @@ func (h *Handler) gcCache() {
 	defer db.Close()
 
 	// Remove the caches which are not completed for a while, they are most likely to be broken.
-	var caches []*Cache
-	if err := findIncompleteCaches(db, caches); err != nil {
+	caches, err := findIncompleteCaches(db)
+	if err != nil {
 		h.logger.Warnf("find caches: %v", err)
 	} else {
 		for _, cache := range caches {
-			h.storage.Remove(cache.ID)
-			if err := deleteCache(db, cache.ID, cache); err != nil {
+			if err := h.removeCache(db, cache); err != nil {
 				h.logger.Warnf("delete cache: %v", err)
 				continue
 			}
@@ -458,13 +1034,12 @@ func (h *Handler) gcCache() {
 	}
 
 	// Remove the old caches which have not been used recently.
-	caches = caches[:0]
-	if err := findUnusedCaches(db, caches); err != nil {
+	caches, err = findUnusedCaches(db)
+	if err != nil {
 		h.logger.Warnf("find caches: %v", err)
 	} else {
 		for _, cache := range caches {
-			h.storage.Remove(cache.ID)
-			if err := deleteCache(db, cache.ID, cache); err != nil {
+			if err := h.removeCache(db, cache); err != nil {
 				h.logger.Warnf("delete cache: %v", err)
 				continue
 			}
@@ -473,13 +1048,12 @@ func (h *Handler) gcCache() {
 	}
 
 	// Remove the old caches which are too old.
-	caches = caches[:0]
-	if err := findOldCaches(db, caches); err != nil {
+	caches, err = findOldCaches(db)
+	if err != nil {
 		h.logger.Warnf("find caches: %v", err)
 	} else {
 		for _, cache := range caches {
-			h.storage.Remove(cache.ID)
-			if err := deleteCache(db, cache.ID, cache); err != nil {
+			if err := h.removeCache(db, cache); err != nil {
 				h.logger.Warnf("delete cache: %v", err)
 				continue
 			}
@@ -505,8 +1079,7 @@ func (h *Handler) gcCache() {
 					// Or it could break downloading in process.
 					continue
 				}
-				h.storage.Remove(cache.ID)
-				if err := deleteCache(db, cache.ID, cache); err != nil {
+				if err := h.removeCache(db, cache); err != nil {
 					h.logger.Warnf("delete cache: %v", err)
 					continue
 				}
@@ -516,6 +1089,58 @@ func (h *Handler) gcCache() {
 	}
 }
 
+// removeCache deletes a cache along with its staged uploads, and its blob once no other cache refers to it.
+func (h *Handler) removeCache(db *bolthold.Store, cache *Cache) error {
+	if err := deleteCache(db, cache.ID, cache); err != nil {
+		return err
+	}
+	storage := h.storage.Namespace(cache.Repo)
+	storage.RemoveTemp(cache.ID)
+	if cache.Sha256 == "" {
+		return nil
+	}
+	refs, err := countBlobRefs(db, cache.Repo, cache.Sha256)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		storage.Remove(cache.Sha256)
+	}
+	return nil
+}
+
+// migrateStorage moves the archives of the caches committed before storage was content-addressed
+// into their blobs. Lookups treat caches without a blob as gone, so it runs before serving.
+func (h *Handler) migrateStorage() error {
+	db, err := h.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var caches []*Cache
+	if err := db.Find(&caches, bolthold.Where("Complete").Eq(true)); err != nil {
+		return fmt.Errorf("find caches: %w", err)
+	}
+	for _, cache := range caches {
+		archive, err := h.storage.Namespace(cache.Repo).Migrate(cache.ID, cache.Sha256)
+		if err != nil {
+			h.logger.Warnf("migrate cache %d: %v", cache.ID, err)
+			continue
+		}
+		if archive == nil {
+			continue
+		}
+		cache.Sha256 = archive.Sha256
+		cache.KeyID = archive.KeyID
+		if err := updateCache(db, cache.ID, cache); err != nil {
+			return err
+		}
+		h.logger.Infof("migrated cache %d to blob %s", cache.ID, cache.Sha256)
+	}
+	return nil
+}
+
 func (h *Handler) responseJSON(w http.ResponseWriter, r *http.Request, code int, v ...any) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	var data []byte
@@ -0,0 +1,646 @@
+package act
+
+import (
+	"act-nexus-cache/nexus/nexustest"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timshannon/bolthold"
+)
+
+const testRepository = "gh-action-cache"
+
+// testServer is a handler pointed at a fake Nexus, requests are served in process.
+type testServer struct {
+	t     *testing.T
+	h     *Handler
+	nexus *nexustest.Server
+}
+
+// newTestServer starts a handler with the environment, on top of a fake Nexus and without
+// background probes unless the environment asks for them.
+func newTestServer(t *testing.T, server *nexustest.Server, env map[string]string) *testServer {
+	t.Helper()
+	defaults := map[string]string{
+		"NEXUS_STORE_ENDPOINT":     server.StoreEndpoint("act-nexus-cache"),
+		"NEXUS_USERNAME":           "gh",
+		"NEXUS_SECRET":             "gh",
+		"NEXUS_PROBE_INTERVAL":     "0",
+		"ACT_CACHE_URL_SECRET":     "secret",
+		"ACT_CACHE_MODE":           "",
+		"ACT_CACHE_DENIED":         "",
+		"ACT_CACHE_TOKEN_POLICIES": "",
+		"NEXUS_REMOTES":            "",
+		"NEXUS_CHUNK_SIZE":         "",
+		"NEXUS_BREAKER_FAILURES":   "",
+	}
+	for name, value := range env {
+		defaults[name] = value
+	}
+	for name, value := range defaults {
+		t.Setenv(name, value)
+	}
+	h, err := StartHandler(t.TempDir(), "127.0.0.1", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := h.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+	return &testServer{t: t, h: h, nexus: server}
+}
+
+// newTestNexus starts a fake Nexus which is closed with the test.
+func newTestNexus(t *testing.T) *nexustest.Server {
+	server := nexustest.NewServer(testRepository)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testKeys returns the encryption keys of the environment of a test.
+func testKeys() string {
+	return "k1=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+}
+
+// do serves a request, the target may be a path or a location returned by a lookup.
+func (s *testServer) do(method string, target string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	s.t.Helper()
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	s.h.router.ServeHTTP(w, r)
+	return w
+}
+
+// reserve reserves a cache, it returns the status and the id of the cache.
+func (s *testServer) reserve(key string, version string, size int, headers map[string]string) (int, int64) {
+	s.t.Helper()
+	request, _ := json.Marshal(&Request{Key: key, Version: version, Size: int64(size)})
+	w := s.do(http.MethodPost, urlBase+"/caches", headers, request)
+	var response struct {
+		CacheID int64 `json:"cacheId"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response.CacheID
+}
+
+// save reserves, uploads and commits a cache with the legacy cache API, then waits for its push.
+func (s *testServer) save(key string, version string, content []byte, headers map[string]string) {
+	s.t.Helper()
+	code, id := s.reserve(key, version, len(content), headers)
+	if code != http.StatusOK {
+		s.t.Fatalf("reserve %q: %d", key, code)
+	}
+	upload := map[string]string{"Content-Range": fmt.Sprintf("bytes 0-%d/*", len(content)-1)}
+	for name, value := range headers {
+		upload[name] = value
+	}
+	if w := s.do(http.MethodPatch, fmt.Sprintf("%s/caches/%d", urlBase, id), upload, content); w.Code != http.StatusOK {
+		s.t.Fatalf("upload %q: %d %s", key, w.Code, w.Body)
+	}
+	if w := s.do(http.MethodPost, fmt.Sprintf("%s/caches/%d", urlBase, id), headers, nil); w.Code != http.StatusOK {
+		s.t.Fatalf("commit %q: %d %s", key, w.Code, w.Body)
+	}
+	s.h.pending.Wait()
+}
+
+// find looks up the keys, it returns the status, the location and the key of a hit.
+func (s *testServer) find(keys []string, version string, headers map[string]string) (int, string, string) {
+	s.t.Helper()
+	w := s.do(http.MethodGet, fmt.Sprintf("%s/cache?keys=%s&version=%s", urlBase, strings.Join(keys, ","), version), headers, nil)
+	var response struct {
+		ArchiveLocation string `json:"archiveLocation"`
+		CacheKey        string `json:"cacheKey"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response.ArchiveLocation, response.CacheKey
+}
+
+func TestRemoteRangesEncrypted(t *testing.T) {
+	server := newTestNexus(t)
+	env := map[string]string{"ACT_CACHE_ENCRYPTION_KEYS": testKeys()}
+	content := randomBytes(3*encChunkSize + 17)
+	newTestServer(t, server, env).save("encrypted", "v1", content, nil)
+
+	// another server has no local copy, its hit is served from Nexus
+	s := newTestServer(t, server, env)
+	code, location, _ := s.find([]string{"encrypted"}, "v1", nil)
+	if code != http.StatusOK || !strings.Contains(location, "/remote/") {
+		t.Fatalf("lookup: %d %q, want a remote hit", code, location)
+	}
+	for _, r := range []struct {
+		header     string
+		start, end int
+	}{
+		{"Range", 0, 99},
+		{"Range", encChunkSize - 10, encChunkSize + 10},
+		{"x-ms-range", 2 * encChunkSize, len(content) - 1},
+	} {
+		w := s.do(http.MethodGet, location, map[string]string{r.header: fmt.Sprintf("bytes=%d-%d", r.start, r.end)}, nil)
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("%s %d-%d: %d", r.header, r.start, r.end, w.Code)
+		}
+		if !bytes.Equal(w.Body.Bytes(), content[r.start:r.end+1]) {
+			t.Fatalf("%s %d-%d: %d bytes differ", r.header, r.start, r.end, w.Body.Len())
+		}
+	}
+	w := s.do(http.MethodGet, location, nil, nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("full download: %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w := s.do(http.MethodHead, location, nil, nil); w.Code != http.StatusOK || w.Header().Get("Content-Length") != fmt.Sprint(len(content)) {
+		t.Fatalf("head: %d, length %s", w.Code, w.Header().Get("Content-Length"))
+	}
+}
+
+func TestLookupRefOrder(t *testing.T) {
+	server := newTestNexus(t)
+	main := map[string]string{refHeader: "refs/heads/main"}
+	newTestServer(t, server, nil).save("deps-main", "v1", []byte("main"), main)
+
+	// saved locally only, the remote holds the cache of the base branch alone
+	s := newTestServer(t, server, map[string]string{"ACT_CACHE_MODE": "read-write,local"})
+	feature := map[string]string{refHeader: "refs/heads/feature", restoreRefsHeader: "refs/heads/main"}
+	s.save("deps-feature", "v1", []byte("feature"), feature)
+
+	code, location, key := s.find([]string{"deps-"}, "v1", feature)
+	if code != http.StatusOK || key != "deps-feature" || strings.Contains(location, "/remote/") {
+		t.Fatalf("lookup on the feature branch: %d %q %q, want the local cache of the branch", code, key, location)
+	}
+	code, location, key = s.find([]string{"deps-"}, "v1", main)
+	if code != http.StatusOK || key != "deps-main" || !strings.Contains(location, "/remote/") {
+		t.Fatalf("lookup on the base branch: %d %q %q, want the remote cache of the branch", code, key, location)
+	}
+}
+
+// ageCache moves the times of the cache with the key back by the age.
+func (s *testServer) ageCache(key string, age time.Duration) *Cache {
+	s.t.Helper()
+	db, err := s.h.openDB()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer db.Close()
+	var caches []*Cache
+	if err := db.Find(&caches, bolthold.Where("Key").Eq(key)); err != nil || len(caches) != 1 {
+		s.t.Fatalf("find cache %q: %d, %v", key, len(caches), err)
+	}
+	cache := caches[0]
+	cache.CreatedAt = time.Now().Add(-age).Unix()
+	cache.UsedAt = cache.CreatedAt
+	if err := updateCache(db, cache.ID, cache); err != nil {
+		s.t.Fatal(err)
+	}
+	return cache
+}
+
+// dropLocal removes the local cache with the key.
+func (s *testServer) dropLocal(key string) {
+	s.t.Helper()
+	cache := s.ageCache(key, 0)
+	db, err := s.h.openDB()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer db.Close()
+	if err := s.h.removeCache(db, cache); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// gc runs a garbage collection right away.
+func (s *testServer) gc() {
+	s.h.gcAt = time.Time{}
+	s.h.gcCache()
+}
+
+func TestGCReleasesBlobs(t *testing.T) {
+	s := newTestServer(t, newTestNexus(t), map[string]string{"ACT_CACHE_MODE": "read-write,local"})
+	s.save("first", "v1", []byte("shared"), nil)
+	s.save("second", "v1", []byte("shared"), nil)
+	blob := s.h.storage.BlobName(s.ageCache("first", keepUnused+time.Hour).Sha256)
+
+	s.gc()
+	if code, _, _ := s.find([]string{"first"}, "v1", nil); code != http.StatusNoContent {
+		t.Fatalf("lookup of the unused cache: %d, want a miss", code)
+	}
+	if _, err := os.Stat(blob); err != nil {
+		t.Fatalf("blob of the cache left: %v", err)
+	}
+
+	s.ageCache("second", keepUsed+time.Hour)
+	s.gc()
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Fatalf("blob of the last cache removed: %v, want it gone", err)
+	}
+}
+
+// health returns the status of the server and the state of its first remote.
+func (s *testServer) health() (string, string) {
+	s.t.Helper()
+	var response struct {
+		Status  string `json:"status"`
+		Remotes []struct {
+			State string `json:"state"`
+		} `json:"remotes"`
+	}
+	if err := json.Unmarshal(s.do(http.MethodGet, "/healthz", nil, nil).Body.Bytes(), &response); err != nil || len(response.Remotes) == 0 {
+		s.t.Fatalf("health: %v", err)
+	}
+	return response.Status, response.Remotes[0].State
+}
+
+func TestBreakerPostponesPushes(t *testing.T) {
+	server := newTestNexus(t)
+	s := newTestServer(t, server, map[string]string{"NEXUS_BREAKER_FAILURES": "1"})
+	rm := s.h.remotes.write
+
+	server.Inject(nexustest.Fault{Method: http.MethodPut, Status: http.StatusServiceUnavailable, Times: 1})
+	s.save("failed", "v1", []byte("failed"), nil)
+	if status, state := s.health(); status != "degraded" || state != "open" {
+		t.Fatalf("health after the failure: %s %s, want degraded open", status, state)
+	}
+	// no request reaches Nexus while the breaker is open
+	requests := len(server.Requests())
+	s.save("skipped", "v1", []byte("skipped"), nil)
+	if len(server.Requests()) != requests {
+		t.Fatalf("requests sent while the breaker is open: %v", server.Requests()[requests:])
+	}
+
+	server.Inject(nexustest.Fault{Prefix: "/service/rest/v1/status", Status: http.StatusServiceUnavailable, Times: 1})
+	s.h.probe(rm)
+	if _, state := s.health(); state != "open" {
+		t.Fatalf("state after a failed probe: %s, want open", state)
+	}
+	s.h.probe(rm)
+	s.h.pending.Wait()
+	if status, state := s.health(); status != "ok" || state != "closed" {
+		t.Fatalf("health after the probe: %s %s, want ok closed", status, state)
+	}
+
+	// the pushes put off meanwhile reached Nexus
+	other := newTestServer(t, server, nil)
+	for _, key := range []string{"failed", "skipped"} {
+		if code, location, _ := other.find([]string{key}, "v1", nil); code != http.StatusOK || !strings.Contains(location, "/remote/") {
+			t.Fatalf("lookup of %q: %d %q, want a remote hit", key, code, location)
+		}
+	}
+}
+
+// twirp calls a method of the cache service v2, it decodes the response into v and returns the
+// status.
+func (s *testServer) twirp(method string, request any, v any, headers map[string]string) int {
+	s.t.Helper()
+	body, _ := json.Marshal(request)
+	all := map[string]string{"Content-Type": "application/json"}
+	for name, value := range headers {
+		all[name] = value
+	}
+	w := s.do(http.MethodPost, twirpBase+"/"+method, all, body)
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			s.t.Fatalf("%s: %v", method, err)
+		}
+	}
+	return w.Code
+}
+
+// createEntry reserves a cache with the cache service v2, it returns the upload URL.
+func (s *testServer) createEntry(key string, version string, headers map[string]string) string {
+	s.t.Helper()
+	response := &createCacheEntryResponse{}
+	if code := s.twirp("CreateCacheEntry", &createCacheEntryRequest{Key: key, Version: version}, response, headers); code != http.StatusOK || !response.Ok {
+		s.t.Fatalf("create %q: %d %+v", key, code, response)
+	}
+	return response.SignedUploadURL
+}
+
+// finalizeEntry commits a cache uploaded with the cache service v2, then waits for its push.
+func (s *testServer) finalizeEntry(key string, version string, size int, headers map[string]string) {
+	s.t.Helper()
+	response := &finalizeCacheEntryUploadResponse{}
+	request := &finalizeCacheEntryUploadRequest{Key: key, Version: version, SizeBytes: protoInt64(size)}
+	if code := s.twirp("FinalizeCacheEntryUpload", request, response, headers); code != http.StatusOK || !response.Ok {
+		s.t.Fatalf("finalize %q: %d %+v", key, code, response)
+	}
+	s.h.pending.Wait()
+}
+
+// downloadEntry looks up a cache with the cache service v2 and downloads its archive.
+func (s *testServer) downloadEntry(key string, version string, headers map[string]string) []byte {
+	s.t.Helper()
+	response := &getCacheEntryDownloadURLResponse{}
+	request := &getCacheEntryDownloadURLRequest{Key: key, Version: version}
+	if code := s.twirp("GetCacheEntryDownloadURL", request, response, headers); code != http.StatusOK || !response.Ok {
+		s.t.Fatalf("lookup %q: %d %+v", key, code, response)
+	}
+	w := s.do(http.MethodGet, response.SignedDownloadURL, nil, nil)
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("download %q: %d", key, w.Code)
+	}
+	return w.Body.Bytes()
+}
+
+// putBlock stages a block of an upload.
+func (s *testServer) putBlock(upload string, blockID string, content string) {
+	s.t.Helper()
+	target := upload + "&comp=block&blockid=" + base64.StdEncoding.EncodeToString([]byte(blockID))
+	if w := s.do(http.MethodPut, target, nil, []byte(content)); w.Code != http.StatusCreated {
+		s.t.Fatalf("put block %q: %d %s", blockID, w.Code, w.Body)
+	}
+}
+
+// putBlockList commits the staged blocks in the order listed, it returns the status.
+func (s *testServer) putBlockList(upload string, blockIDs ...string) int {
+	s.t.Helper()
+	var list strings.Builder
+	list.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?><BlockList>")
+	for _, blockID := range blockIDs {
+		fmt.Fprintf(&list, "<Latest>%s</Latest>", base64.StdEncoding.EncodeToString([]byte(blockID)))
+	}
+	list.WriteString("</BlockList>")
+	return s.do(http.MethodPut, upload+"&comp=blocklist", nil, []byte(list.String())).Code
+}
+
+func TestPutBlockList(t *testing.T) {
+	s := newTestServer(t, newTestNexus(t), map[string]string{"ACT_CACHE_MODE": "read-write,local"})
+
+	// blocks are laid out in the order of the list rather than the order they were staged in,
+	// the blocks left out are dropped
+	upload := s.createEntry("blocks", "v1", nil)
+	s.putBlock(upload, "b", "second,")
+	s.putBlock(upload, "c", "unused")
+	s.putBlock(upload, "a", "first,")
+	s.putBlock(upload, "d", "third")
+	if code := s.putBlockList(upload, "a", "b", "a"); code != http.StatusBadRequest {
+		t.Fatalf("list with a block twice: %d, want 400", code)
+	}
+	if code := s.putBlockList(upload, "a", "missing"); code != http.StatusBadRequest {
+		t.Fatalf("list with a block never staged: %d, want 400", code)
+	}
+	if code := s.putBlockList(upload, "a", "b", "d"); code != http.StatusCreated {
+		t.Fatalf("put block list: %d", code)
+	}
+	s.finalizeEntry("blocks", "v1", len("first,second,third"), nil)
+	if content := s.downloadEntry("blocks", "v1", nil); string(content) != "first,second,third" {
+		t.Fatalf("downloaded %q", content)
+	}
+
+	// a whole upload replaces the blocks uploaded before it, listed or not
+	upload = s.createEntry("whole", "v1", nil)
+	s.putBlock(upload, "a", "listed,")
+	s.putBlock(upload, "b", "listed")
+	if code := s.putBlockList(upload, "a", "b"); code != http.StatusCreated {
+		t.Fatalf("put block list: %d", code)
+	}
+	s.putBlock(upload, "c", "staged")
+	if w := s.do(http.MethodPut, upload, nil, []byte("whole")); w.Code != http.StatusCreated {
+		t.Fatalf("put blob: %d", w.Code)
+	}
+	s.finalizeEntry("whole", "v1", len("whole"), nil)
+	if content := s.downloadEntry("whole", "v1", nil); string(content) != "whole" {
+		t.Fatalf("downloaded %q", content)
+	}
+}
+
+func TestPolicyPerToken(t *testing.T) {
+	tokens := t.TempDir() + "/tokens"
+	if err := os.WriteFile(tokens, []byte("# forks\nfork read-only\nseed write-only\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fork := map[string]string{"Authorization": "Bearer fork"}
+	seed := map[string]string{"Authorization": "Bearer seed"}
+
+	server := newTestNexus(t)
+	forbid := newTestServer(t, server, map[string]string{"ACT_CACHE_TOKEN_POLICIES": tokens})
+	forbid.save("seeded", "v1", []byte("seeded"), seed)
+	if code, _ := forbid.reserve("fork", "v1", 4, fork); code != http.StatusForbidden {
+		t.Fatalf("forbid, reserve with the read-only token: %d, want 403", code)
+	}
+	if code, _, _ := forbid.find([]string{"seeded"}, "v1", seed); code != http.StatusForbidden {
+		t.Fatalf("forbid, lookup with the write-only token: %d, want 403", code)
+	}
+	if code, _, key := forbid.find([]string{"seeded"}, "v1", fork); code != http.StatusOK || key != "seeded" {
+		t.Fatalf("forbid, lookup with the read-only token: %d %q", code, key)
+	}
+	if code := forbid.twirp("CreateCacheEntry", &createCacheEntryRequest{Key: "fork", Version: "v1"}, nil, fork); code != http.StatusForbidden {
+		t.Fatalf("forbid, create entry with the read-only token: %d, want 403", code)
+	}
+
+	ignore := newTestServer(t, server, map[string]string{"ACT_CACHE_TOKEN_POLICIES": tokens, "ACT_CACHE_DENIED": "ignore"})
+	if code, _, _ := ignore.find([]string{"seeded"}, "v1", seed); code != http.StatusNoContent {
+		t.Fatalf("ignore, lookup with the write-only token: %d, want a miss", code)
+	}
+	// the save of the read-only token goes through the motions and is dropped
+	if code, id := ignore.reserve("fork", "v1", 4, fork); code != http.StatusOK || id != discardID {
+		t.Fatalf("ignore, reserve with the read-only token: %d %d, want %d", code, id, discardID)
+	}
+	ignore.save("fork", "v1", []byte("fork"), fork)
+	upload := ignore.createEntry("fork", "v2", fork)
+	if w := ignore.do(http.MethodPut, upload, nil, []byte("fork")); w.Code != http.StatusCreated {
+		t.Fatalf("ignore, upload of the read-only token: %d", w.Code)
+	}
+	ignore.finalizeEntry("fork", "v2", 4, fork)
+	for _, version := range []string{"v1", "v2"} {
+		if code, _, _ := ignore.find([]string{"fork"}, version, nil); code != http.StatusNoContent {
+			t.Fatalf("ignore, lookup of the dropped save %s: %d, want a miss", version, code)
+		}
+	}
+}
+
+func TestSignedLocations(t *testing.T) {
+	s := newTestServer(t, newTestNexus(t), nil)
+	s.save("signed", "v1", []byte("signed"), nil)
+
+	// the server which saved the cache hands out its local copy, another one the copy of Nexus
+	for _, s := range []*testServer{s, newTestServer(t, s.nexus, nil)} {
+		code, location, _ := s.find([]string{"signed"}, "v1", nil)
+		if code != http.StatusOK {
+			t.Fatalf("lookup: %d", code)
+		}
+		if w := s.do(http.MethodGet, location, nil, nil); w.Code != http.StatusOK || w.Body.String() != "signed" {
+			t.Fatalf("download of %s: %d %q", location, w.Code, w.Body)
+		}
+		u, err := url.Parse(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		expired := time.Now().Add(-time.Minute).Unix()
+		for name, values := range map[string]url.Values{
+			"unsigned": {},
+			"tampered": {expiresParam: {query.Get(expiresParam)}, signatureParam: {strings.Repeat("0", len(query.Get(signatureParam)))}},
+			"extended": {expiresParam: {fmt.Sprint(time.Now().Add(24 * time.Hour).Unix())}, signatureParam: {query.Get(signatureParam)}},
+			"expired":  {expiresParam: {fmt.Sprint(expired)}, signatureParam: {s.h.signer.signature(u.Path, expired)}},
+		} {
+			target := u.Path + "?" + values.Encode()
+			if w := s.do(http.MethodGet, target, nil, nil); w.Code != http.StatusForbidden {
+				t.Fatalf("%s download of %s: %d, want 403", name, u.Path, w.Code)
+			}
+		}
+		// a signature is only good for the path it was made for
+		other := u.Path + "0"
+		if w := s.do(http.MethodGet, other+"?"+query.Encode(), nil, nil); w.Code != http.StatusForbidden {
+			t.Fatalf("download of %s signed for %s: %d, want 403", other, u.Path, w.Code)
+		}
+	}
+}
+
+// twirpRaw posts a body to a method of the cache service v2 as is, it returns the status and the
+// Twirp error code.
+func (s *testServer) twirpRaw(method string, contentType string, body string) (int, string) {
+	s.t.Helper()
+	w := s.do(http.MethodPost, twirpBase+"/"+method, map[string]string{"Content-Type": contentType}, []byte(body))
+	var response struct {
+		Code string `json:"code"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response.Code
+}
+
+func TestTwirpCacheService(t *testing.T) {
+	s := newTestServer(t, newTestNexus(t), nil)
+	main := map[string]string{refHeader: "refs/heads/main"}
+
+	upload := s.createEntry("deps-1", "v1", main)
+	if w := s.do(http.MethodPut, upload, nil, []byte("deps")); w.Code != http.StatusCreated {
+		t.Fatalf("upload: %d", w.Code)
+	}
+	s.finalizeEntry("deps-1", "v1", 4, main)
+	if content := s.downloadEntry("deps-1", "v1", main); string(content) != "deps" {
+		t.Fatalf("downloaded %q", content)
+	}
+
+	// the field names of the proto are accepted as well, and the refs come from the metadata
+	lookup := `{"metadata": {"repository_id": "1", "scope": [{"scope": "refs/heads/feature", "permission": "3"},
+		{"scope": "refs/heads/main", "permission": 1}]}, "key": "deps-2", "restore_keys": ["deps-"], "version": "v1"}`
+	w := s.do(http.MethodPost, twirpBase+"/GetCacheEntryDownloadURL", map[string]string{"Content-Type": "application/json"}, []byte(lookup))
+	response := &getCacheEntryDownloadURLResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), response); err != nil || w.Code != http.StatusOK || !response.Ok || response.MatchedKey != "deps-1" {
+		t.Fatalf("lookup by restore key: %d %s", w.Code, w.Body)
+	}
+
+	// a miss is answered with ok false
+	miss := &getCacheEntryDownloadURLResponse{}
+	if code := s.twirp("GetCacheEntryDownloadURL", &getCacheEntryDownloadURLRequest{Key: "other", Version: "v1"}, miss, main); code != http.StatusOK || miss.Ok {
+		t.Fatalf("lookup of a missing key: %d %+v", code, miss)
+	}
+
+	for _, c := range []struct {
+		name, method, contentType, body string
+		status                          int
+		code                            string
+	}{
+		{"existing key", "CreateCacheEntry", "application/json", `{"metadata": {"scope": [{"scope": "refs/heads/main", "permission": 3}]}, "key": "deps-1", "version": "v1"}`, http.StatusConflict, twirpAlreadyExists},
+		{"no version", "CreateCacheEntry", "application/json", `{"key": "deps-3"}`, http.StatusBadRequest, twirpInvalidArgument},
+		{"protobuf", "CreateCacheEntry", "application/protobuf", "", http.StatusBadRequest, twirpMalformed},
+		{"not reserved", "FinalizeCacheEntryUpload", "application/json", `{"key": "deps-4", "version": "v1", "sizeBytes": "4"}`, http.StatusNotFound, twirpNotFound},
+	} {
+		if status, code := s.twirpRaw(c.method, c.contentType, c.body); status != c.status || code != c.code {
+			t.Errorf("%s: %d %s, want %d %s", c.name, status, code, c.status, c.code)
+		}
+	}
+}
+
+func TestReserveConflicts(t *testing.T) {
+	server := newTestNexus(t)
+	s := newTestServer(t, server, nil)
+
+	if code, _ := s.reserve("matrix", "v1", 6, nil); code != http.StatusOK {
+		t.Fatalf("reserve: %d", code)
+	}
+	if code, _ := s.reserve("MATRIX", "v1", 6, nil); code != http.StatusConflict {
+		t.Fatalf("reserve of a key being uploaded: %d, want 409", code)
+	}
+	if code, _ := s.reserve("matrix", "v2", 6, nil); code != http.StatusOK {
+		t.Fatalf("reserve of another version: %d", code)
+	}
+	if code, _ := s.reserve("matrix", "v1", 6, map[string]string{refHeader: "refs/heads/feature"}); code != http.StatusOK {
+		t.Fatalf("reserve in another ref: %d", code)
+	}
+
+	// the reservation of an uploader which is gone expires with its lease
+	code, first := s.reserve("lease", "v1", 6, nil)
+	if code != http.StatusOK {
+		t.Fatalf("reserve: %d", code)
+	}
+	s.ageCache("lease", keepTemp+time.Minute)
+	code, second := s.reserve("lease", "v1", 6, nil)
+	if code != http.StatusOK || second == first {
+		t.Fatalf("reserve after the lease expired: %d %d", code, second)
+	}
+	upload := map[string]string{"Content-Range": "bytes 0-5/*"}
+	if w := s.do(http.MethodPatch, fmt.Sprintf("%s/caches/%d", urlBase, first), upload, []byte("matrix")); w.Code != http.StatusBadRequest {
+		t.Fatalf("upload to the expired reservation: %d, want 400", w.Code)
+	}
+
+	// saved keys are immutable, here and in Nexus
+	s.save("saved", "v1", []byte("saved"), nil)
+	if code, _ := s.reserve("saved", "v1", 5, nil); code != http.StatusConflict {
+		t.Fatalf("reserve of a saved key: %d, want 409", code)
+	}
+	if code, _ := newTestServer(t, server, nil).reserve("saved", "v1", 5, nil); code != http.StatusConflict {
+		t.Fatalf("reserve of a key saved in Nexus: %d, want 409", code)
+	}
+}
+
+// searches counts the searches the fake Nexus served.
+func (s *testServer) searches() int {
+	n := 0
+	for _, request := range s.nexus.Requests() {
+		if strings.Contains(request, "/search/assets") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLookupCache(t *testing.T) {
+	server := newTestNexus(t)
+	newTestServer(t, server, nil).save("deps-1", "v1", []byte("deps"), nil)
+
+	s := newTestServer(t, server, nil)
+	for _, keys := range [][]string{{"deps-1"}, {"other"}} {
+		s.find(keys, "v1", nil)
+		before := s.searches()
+		code, _, _ := s.find(keys, "v1", nil)
+		if after := s.searches(); after != before {
+			t.Fatalf("lookup of %q again: %d searches, want none", keys, after-before)
+		}
+		if want := map[string]int{"deps-1": http.StatusOK, "other": http.StatusNoContent}[keys[0]]; code != want {
+			t.Fatalf("lookup of %q again: %d, want %d", keys, code, want)
+		}
+	}
+
+	// the push of a commit of the key drops the miss remembered, the lookup finds the copy of
+	// Nexus once the local one is gone
+	s.save("other", "v1", []byte("other"), nil)
+	s.dropLocal("other")
+	if code, location, _ := s.find([]string{"other"}, "v1", nil); code != http.StatusOK || !strings.Contains(location, "/remote/") {
+		t.Fatalf("lookup after the commit: %d %q, want a remote hit", code, location)
+	}
+
+	uncached := newTestServer(t, server, map[string]string{"ACT_CACHE_LOOKUP_MISS_TTL": "0"})
+	uncached.find([]string{"missing"}, "v1", nil)
+	before := uncached.searches()
+	uncached.find([]string{"missing"}, "v1", nil)
+	if uncached.searches() == before {
+		t.Fatal("misses remembered with a TTL of 0")
+	}
+}
@@ -0,0 +1,83 @@
+package act
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+var errCorrupt = errors.New("archive does not match its sha256")
+
+// verifyReader passes a stream through while hashing it, and holds the last block back until the
+// end of the stream is reached. When the digest does not match, the held block is dropped and
+// errCorrupt is returned, so a corrupt archive never reaches the client complete and the tar
+// extraction in the job fails on the short read rather than on garbage.
+type verifyReader struct {
+	r    io.Reader
+	want string
+	hash hash.Hash
+
+	// ready is released to the caller, held is the last block read and spare the free buffer
+	ready  []byte
+	held   []byte
+	spare  []byte
+	done   bool
+	failed bool
+}
+
+func newVerifyReader(r io.Reader, want string) *verifyReader {
+	return &verifyReader{
+		r:     r,
+		want:  want,
+		hash:  sha256.New(),
+		held:  make([]byte, 0, 32*1024),
+		spare: make([]byte, 0, 32*1024),
+	}
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	for len(v.ready) == 0 {
+		if v.done {
+			if len(v.held) == 0 {
+				return 0, io.EOF
+			}
+			v.ready, v.held = v.held, nil
+			continue
+		}
+		if err := v.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, v.ready)
+	v.ready = v.ready[n:]
+	return n, nil
+}
+
+// fill reads the next block, which releases the previously held one.
+func (v *verifyReader) fill() error {
+	buf := v.spare[:cap(v.spare)]
+	n, err := v.r.Read(buf)
+	v.hash.Write(buf[:n])
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if n > 0 {
+		v.ready, v.held, v.spare = v.held, buf[:n], v.held[:0]
+	}
+	if errors.Is(err, io.EOF) {
+		v.done = true
+		if hex.EncodeToString(v.hash.Sum(nil)) != v.want {
+			v.failed = true
+			v.ready, v.held = nil, nil
+			return errCorrupt
+		}
+	}
+	return nil
+}
+
+// Corrupt reports whether the stream was read to the end and did not match.
+func (v *verifyReader) Corrupt() bool {
+	return v.failed
+}
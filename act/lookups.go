@@ -0,0 +1,118 @@
+package act
+
+import (
+	"act-nexus-cache/nexus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lookupCache remembers what the remote tier answered to a lookup for a short while, so that
+// the jobs of a matrix looking up the same keys do not search Nexus over and over. Hits and
+// misses are kept for their own TTL, a TTL of 0 does not keep them.
+type lookupCache struct {
+	hitTTL  time.Duration
+	missTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[lookupKey]*lookupEntry
+}
+
+// lookupKey identifies a lookup, the refs and the keys are joined in their order.
+type lookupKey struct {
+	namespace string
+	refs      string
+	keys      string
+	version   string
+}
+
+type lookupEntry struct {
+	keys    []string
+	remote  *remote
+	cache   *nexus.Cache
+	expires time.Time
+}
+
+func newLookupCache(hitTTL time.Duration, missTTL time.Duration) *lookupCache {
+	return &lookupCache{
+		hitTTL:  hitTTL,
+		missTTL: missTTL,
+		entries: map[lookupKey]*lookupEntry{},
+	}
+}
+
+func newLookupKey(namespace string, refs []string, keys []string, version string) lookupKey {
+	return lookupKey{
+		namespace: namespace,
+		refs:      strings.Join(refs, "\x00"),
+		keys:      strings.Join(keys, "\x00"),
+		version:   version,
+	}
+}
+
+// get returns the remembered answer to a lookup, ok is false when there is none. A miss is
+// remembered as a nil cache.
+func (c *lookupCache) get(key lookupKey) (*remote, *nexus.Cache, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, nil, false
+	}
+	return entry.remote, entry.cache, true
+}
+
+// put remembers the answer to a lookup of the keys, a nil cache for a miss.
+func (c *lookupCache) put(key lookupKey, keys []string, rm *remote, cache *nexus.Cache) {
+	ttl := c.hitTTL
+	if cache == nil {
+		ttl = c.missTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &lookupEntry{
+		keys:    append([]string(nil), keys...),
+		remote:  rm,
+		cache:   cache,
+		expires: now.Add(ttl),
+	}
+}
+
+// invalidate forgets the lookups a cache committed with the key and version may answer now: the
+// lookups of the version in the namespace with a key which is a prefix of it.
+func (c *lookupCache) invalidate(namespace string, key string, version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, entry := range c.entries {
+		if k.namespace != namespace || k.version != version {
+			continue
+		}
+		for _, prefix := range entry.keys {
+			if strings.HasPrefix(key, prefix) {
+				delete(c.entries, k)
+				break
+			}
+		}
+	}
+}
+
+// forget forgets the lookups answered with an asset of a remote, once it is quarantined.
+func (c *lookupCache) forget(rm *remote, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, entry := range c.entries {
+		if entry.remote == rm && entry.cache != nil && entry.cache.Path == path {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -23,12 +23,19 @@ func (c *Request) ToCache() *Cache {
 	return ret
 }
 
+// Cache is a cache entry. Quarantined entries failed verification, they are kept for inspection
+// but never restored.
 type Cache struct {
-	ID        uint64 `json:"id" boltholdKey:"ID"`
-	Key       string `json:"key" boltholdIndex:"Key"`
-	Version   string `json:"version" boltholdIndex:"Version"`
-	Size      int64  `json:"cacheSize"`
-	Complete  bool   `json:"complete" boltholdIndex:"Complete"`
-	UsedAt    int64  `json:"usedAt" boltholdIndex:"UsedAt"`
-	CreatedAt int64  `json:"createdAt" boltholdIndex:"CreatedAt"`
+	ID          uint64 `json:"id" boltholdKey:"ID"`
+	Repo        string `json:"repo" boltholdIndex:"Repo"`
+	Ref         string `json:"ref" boltholdIndex:"Ref"`
+	Key         string `json:"key" boltholdIndex:"Key"`
+	Version     string `json:"version" boltholdIndex:"Version"`
+	Size        int64  `json:"cacheSize"`
+	KeyID       string `json:"keyId,omitempty"`
+	Sha256      string `json:"sha256,omitempty"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+	Complete    bool   `json:"complete" boltholdIndex:"Complete"`
+	UsedAt      int64  `json:"usedAt" boltholdIndex:"UsedAt"`
+	CreatedAt   int64  `json:"createdAt" boltholdIndex:"CreatedAt"`
 }
@@ -0,0 +1,140 @@
+package act
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	modeReadWrite = "read-write"
+	modeReadOnly  = "read-only"
+	modeWriteOnly = "write-only"
+	// modeLocal keeps the caches saved under a policy out of the remotes, they are saved locally only.
+	modeLocal = "local"
+)
+
+// discardID is the cache id answered to reservations while denied saves are ignored, the ids of
+// caches are positive. The toolkit takes it for a cache id like any other: it uploads the archive
+// to it, commits it and logs the cache as saved. The uploads are drained and dropped, answering
+// them with an error would have the toolkit warn about a save the policy meant to skip quietly.
+const discardID int64 = -1
+
+var (
+	errRestoreDenied = errors.New("restores are not allowed by the policy")
+	errSaveDenied    = errors.New("saves are not allowed by the policy")
+)
+
+// policy is what the requests of a token may do.
+type policy struct {
+	restore bool
+	save    bool
+	// push uploads the caches saved under the policy to the remotes.
+	push bool
+}
+
+// policies are the server-wide policy and the policies of tokens, which replace it for the
+// requests carrying them. Denied requests are answered with a 403, or as a no-op the toolkit
+// accepts when ignore is set: lookups miss and saves are dropped.
+type policies struct {
+	server policy
+	tokens map[string]policy
+	ignore bool
+}
+
+// loadPolicies reads the policies from the environment. ACT_CACHE_MODE is the server-wide policy
+// and ACT_CACHE_TOKEN_POLICIES a file of the policies of tokens, a token and a policy per line.
+// ACT_CACHE_DENIED is forbid, the default, or ignore.
+func loadPolicies() (*policies, error) {
+	p := &policies{tokens: map[string]policy{}}
+	var err error
+	if p.server, err = parsePolicy(os.Getenv("ACT_CACHE_MODE")); err != nil {
+		return nil, fmt.Errorf("ACT_CACHE_MODE: %w", err)
+	}
+	switch v := os.Getenv("ACT_CACHE_DENIED"); v {
+	case "", "forbid":
+	case "ignore":
+		p.ignore = true
+	default:
+		return nil, fmt.Errorf("ACT_CACHE_DENIED: unknown value %q", v)
+	}
+
+	if file := os.Getenv("ACT_CACHE_TOKEN_POLICIES"); file != "" {
+		if p.tokens, err = readTokenPolicies(file); err != nil {
+			return nil, fmt.Errorf("ACT_CACHE_TOKEN_POLICIES: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// parsePolicy parses a comma separated mode, read-write by default, and the local option.
+func parsePolicy(s string) (policy, error) {
+	p := policy{restore: true, save: true, push: true}
+	mode := ""
+	for _, word := range strings.Split(s, ",") {
+		switch word = strings.TrimSpace(word); word {
+		case "":
+		case modeLocal:
+			p.push = false
+		case modeReadWrite, modeReadOnly, modeWriteOnly:
+			if mode != "" {
+				return policy{}, fmt.Errorf("modes %s and %s are exclusive", mode, word)
+			}
+			mode = word
+		default:
+			return policy{}, fmt.Errorf("unknown mode %q", word)
+		}
+	}
+	switch mode {
+	case modeReadOnly:
+		p.save = false
+	case modeWriteOnly:
+		p.restore = false
+	}
+	return p, nil
+}
+
+// readTokenPolicies reads a file of tokens and their policies, like
+//
+//	# fork pull requests
+//	<token> read-only
+//	<token> write-only,local
+func readTokenPolicies(file string) (map[string]policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := map[string]policy{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want a token and a policy", n)
+		}
+		p, err := parsePolicy(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		tokens[fields[0]] = p
+	}
+	return tokens, scanner.Err()
+}
+
+// of returns the policy of a request, the policy of its bearer token or the server-wide one.
+func (p *policies) of(r *http.Request) policy {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if tp, ok := p.tokens[token]; ok {
+			return tp
+		}
+	}
+	return p.server
+}
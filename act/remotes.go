@@ -0,0 +1,205 @@
+package act
+
+import (
+	"act-nexus-cache/nexus"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRemote is the name of the remote configured by the NEXUS_ variables when NEXUS_REMOTES is unset.
+const defaultRemote = "nexus"
+
+// remoteName is what a remote may be called, it becomes a segment of download URLs.
+var remoteName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// errUnknownRemote is returned for a download of a remote which is not configured.
+var errUnknownRemote = errors.New("unknown remote")
+
+// remote is a Nexus repository caches are looked up in and pushed to.
+type remote struct {
+	name    string
+	nexus   *nexus.CacheService
+	breaker *breaker
+
+	// postponed holds the ids of the caches whose push was put off while the breaker was open
+	mu        sync.Mutex
+	postponed map[uint64]struct{}
+}
+
+// remotes are the Nexus repositories in the order of their priority. Lookups query all of them,
+// commits are pushed to the write remote and, when replicating, to the others as well.
+type remotes struct {
+	list      []*remote
+	write     *remote
+	replicate bool
+}
+
+// loadRemotes configures the remotes from the environment. NEXUS_REMOTES lists their names in
+// the order of priority, each is configured by variables prefixed with NEXUS_<NAME>_ like the
+// NEXUS_ variables of a single remote. NEXUS_WRITE_REMOTE names the remote commits are pushed
+// to, the first one by default, and NEXUS_REPLICATE pushes them to the others too. Chunking is
+// refused when archives are encrypted.
+func loadRemotes(encrypted bool) (*remotes, error) {
+	names := []string{defaultRemote}
+	if v := os.Getenv("NEXUS_REMOTES"); v != "" {
+		names = names[:0]
+		for _, name := range strings.Split(v, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+
+	r := &remotes{replicate: envBool("NEXUS_REPLICATE", false)}
+	for _, name := range names {
+		if !remoteName.MatchString(name) {
+			return nil, fmt.Errorf("invalid remote name %q", name)
+		}
+		if r.get(name) != nil {
+			return nil, fmt.Errorf("remote %q is listed twice", name)
+		}
+		prefix := "NEXUS_"
+		if os.Getenv("NEXUS_REMOTES") != "" {
+			prefix = "NEXUS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		}
+		rm, err := newRemote(name, prefix, encrypted)
+		if err != nil {
+			return nil, fmt.Errorf("remote %s: %w", name, err)
+		}
+		r.list = append(r.list, rm)
+	}
+
+	r.write = r.list[0]
+	if name := os.Getenv("NEXUS_WRITE_REMOTE"); name != "" {
+		if r.write = r.get(name); r.write == nil {
+			return nil, fmt.Errorf("NEXUS_WRITE_REMOTE: unknown remote %q", name)
+		}
+	}
+	return r, nil
+}
+
+// newRemote configures a remote from the environment variables of a prefix.
+func newRemote(name string, prefix string, encrypted bool) (*remote, error) {
+	endpoint := os.Getenv(prefix + "STORE_ENDPOINT")
+	if endpoint == "" {
+		return nil, fmt.Errorf("%sSTORE_ENDPOINT is not set", prefix)
+	}
+	service := nexus.NewCacheService(endpoint)
+
+	credentials, err := nexusCredentials(prefix, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	service.SetCredentials(credentials)
+	client, err := nexusClient(prefix)
+	if err != nil {
+		return nil, err
+	}
+	service.SetClient(client)
+	service.SetRequestTimeout(envDuration(prefix+"REQUEST_TIMEOUT", 30*time.Second))
+	if size := envSize(prefix+"CHUNK_SIZE", 0); size > 0 {
+		// every archive is encrypted with a key of its own, so encrypted archives never share chunks
+		if encrypted {
+			return nil, fmt.Errorf("%sCHUNK_SIZE: encrypted archives can not be chunked", prefix)
+		}
+		service.SetChunkSize(int(size))
+	}
+	if size := envSize(prefix+"PART_SIZE", -1); size >= 0 {
+		service.SetPartSize(size)
+	}
+	return &remote{
+		name:    name,
+		nexus:   service,
+		breaker: newBreaker(envInt(prefix+"BREAKER_FAILURES", 5), envDuration(prefix+"PROBE_INTERVAL", 30*time.Second)),
+	}, nil
+}
+
+// record feeds the outcome of a request to the remote into its breaker, and logs when it trips.
+func (rm *remote) record(logger logrus.FieldLogger, err error) {
+	if rm.breaker.record(err) {
+		logger.Warnf("remote %s is unavailable after %d failures, serving local caches only until it recovers: %v",
+			rm.name, rm.breaker.threshold, err)
+	}
+}
+
+// postpone queues the push of a cache until the remote recovers.
+func (rm *remote) postpone(id uint64) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.postponed == nil {
+		rm.postponed = map[uint64]struct{}{}
+	}
+	rm.postponed[id] = struct{}{}
+}
+
+// takePostponed empties the queue of postponed pushes and returns the ids of their caches.
+func (rm *remote) takePostponed() []uint64 {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	ids := make([]uint64, 0, len(rm.postponed))
+	for id := range rm.postponed {
+		ids = append(ids, id)
+	}
+	rm.postponed = nil
+	slices.Sort(ids)
+	return ids
+}
+
+// get returns the remote of a name, or nil.
+func (r *remotes) get(name string) *remote {
+	for _, rm := range r.list {
+		if rm.name == name {
+			return rm
+		}
+	}
+	return nil
+}
+
+// find looks the keys up in all remotes at once, the hit of the remote of the highest priority
+// wins. A remote which fails is logged and passed over, the failures of the remotes which were
+// asked before the answer was settled are returned along with it. Remotes whose breaker is open
+// are not asked, they fail with errRemoteUnavailable.
+func (r *remotes) find(logger logrus.FieldLogger, namespace string, refs []string, keys []string, version string) (*remote, *nexus.Cache, error) {
+	type result struct {
+		cache *nexus.Cache
+		err   error
+	}
+	results := make([]chan result, len(r.list))
+	for i, rm := range r.list {
+		results[i] = make(chan result, 1)
+		if !rm.breaker.allow() {
+			results[i] <- result{nil, errRemoteUnavailable}
+			continue
+		}
+		go func(rm *remote, results chan<- result) {
+			cache, err := rm.nexus.FindCache(namespace, refs, keys, version)
+			rm.record(logger, err)
+			results <- result{cache, err}
+		}(rm, results[i])
+	}
+
+	// the remotes of lower priority are left to finish on their own, their requests are bounded
+	var errs []error
+	for i, rm := range r.list {
+		res := <-results[i]
+		if errors.Is(res.err, errRemoteUnavailable) {
+			errs = append(errs, fmt.Errorf("remote %s: %w", rm.name, res.err))
+			continue
+		}
+		if res.err != nil {
+			logger.Warnf("find cache %q in remote %s: %v", keys[0], rm.name, res.err)
+			errs = append(errs, fmt.Errorf("remote %s: %w", rm.name, res.err))
+			continue
+		}
+		if res.cache != nil {
+			return rm, res.cache, errors.Join(errs...)
+		}
+	}
+	return nil, nil, errors.Join(errs...)
+}
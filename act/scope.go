@@ -0,0 +1,166 @@
+package act
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// repositoryHeader lets a proxy in front of the cache server pin the repository of a request.
+	repositoryHeader = "X-Cache-Repository"
+	// refHeader is the ref the job runs on, caches are saved to it and restored from it first.
+	refHeader = "X-Cache-Ref"
+	// restoreRefsHeader is a comma separated list of refs to restore from when the ref has no hit,
+	// usually the base branch of a pull request followed by the default branch.
+	restoreRefsHeader = "X-Cache-Restore-Refs"
+	// repoBase is the route prefix used when the repository is part of the URL,
+	// e.g. ACTIONS_CACHE_URL=http://host:9900/repos/owner/name/
+	repoBase = "/repos/:owner/:repo"
+)
+
+const (
+	permissionRead  = 1
+	permissionWrite = 2
+)
+
+var repositoryPattern = regexp.MustCompile(`^[a-z0-9_.-]+/[a-z0-9_.-]+$`)
+
+// runtimeClaims is the subset of the ACTIONS_RUNTIME_TOKEN claims the cache server understands.
+type runtimeClaims struct {
+	Repository string `json:"repository"`
+	// AccessControl is a JSON encoded list of the cache scopes, GitHub grants read and write to
+	// the ref of the job and read only to the refs it may restore from.
+	AccessControl string `json:"ac"`
+}
+
+type accessScope struct {
+	Scope      string `json:"Scope"`
+	Permission int    `json:"Permission"`
+}
+
+// scope is where a request may save caches to and restore caches from.
+type scope struct {
+	Repo string
+	// Ref is the ref caches are saved to.
+	Ref string
+	// RestoreRefs are the refs caches are restored from after Ref, in order.
+	RestoreRefs []string
+}
+
+// lookupRefs returns the refs to restore from in order, nil when the request carries no ref
+// and lookups are not restricted by ref.
+func (s *scope) lookupRefs() []string {
+	var refs []string
+	for _, ref := range append([]string{s.Ref}, s.RestoreRefs...) {
+		if ref != "" && !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// parseRuntimeToken decodes the claims of the bearer token sent by the runner.
+// The signature is not verified, the claims are trusted as much as the headers are.
+func parseRuntimeToken(r *http.Request) *runtimeClaims {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	claims := &runtimeClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil
+	}
+	return claims
+}
+
+// refs returns the writable ref and the read only refs granted by the token.
+func (c *runtimeClaims) refs() (string, []string) {
+	var scopes []accessScope
+	if c.AccessControl == "" || json.Unmarshal([]byte(c.AccessControl), &scopes) != nil {
+		return "", nil
+	}
+	return scopeRefs(scopes)
+}
+
+// scopeRefs returns the writable ref and the read only refs of cache scopes.
+func scopeRefs(scopes []accessScope) (string, []string) {
+	var ref string
+	var restoreRefs []string
+	for _, s := range scopes {
+		if s.Permission&permissionWrite != 0 && ref == "" {
+			ref = s.Scope
+		} else if s.Permission&permissionRead != 0 {
+			restoreRefs = append(restoreRefs, s.Scope)
+		}
+	}
+	return ref, restoreRefs
+}
+
+// requestScope resolves the scope of a request.
+//
+// The repository is taken, in order of precedence, from the token claims, the X-Cache-Repository
+// header and the /repos/:owner/:repo path segment. An empty repository is the shared namespace
+// used by runners that send none of them.
+//
+// The refs are taken from the token claims, or the X-Cache-Ref and X-Cache-Restore-Refs headers.
+func requestScope(r *http.Request, params httprouter.Params) (*scope, error) {
+	s := &scope{}
+	claims := parseRuntimeToken(r)
+	if claims != nil && claims.Repository != "" {
+		s.Repo = claims.Repository
+	} else if v := r.Header.Get(repositoryHeader); v != "" {
+		s.Repo = v
+	} else if owner := params.ByName("owner"); owner != "" {
+		s.Repo = owner + "/" + params.ByName("repo")
+	}
+
+	if claims != nil {
+		s.Ref, s.RestoreRefs = claims.refs()
+	}
+	if s.Ref == "" && len(s.RestoreRefs) == 0 {
+		s.Ref = r.Header.Get(refHeader)
+		for _, ref := range strings.Split(r.Header.Get(restoreRefsHeader), ",") {
+			if ref = strings.TrimSpace(ref); ref != "" {
+				s.RestoreRefs = append(s.RestoreRefs, ref)
+			}
+		}
+	}
+
+	s.Repo = strings.Trim(strings.ToLower(s.Repo), "/")
+	if s.Repo == "" {
+		return s, nil
+	}
+	if !repositoryPattern.MatchString(s.Repo) {
+		return nil, fmt.Errorf("invalid repository %q", s.Repo)
+	}
+	for _, segment := range strings.Split(s.Repo, "/") {
+		if segment == "." || segment == ".." {
+			return nil, fmt.Errorf("invalid repository %q", s.Repo)
+		}
+	}
+	return s, nil
+}
+
+// repoURLBase returns the route prefix of a repository, archive locations always carry the
+// repository in the path since downloads are made without the runtime token.
+func repoURLBase(repo string) string {
+	if repo == "" {
+		return urlBase
+	}
+	return "/repos/" + repo + urlBase
+}
@@ -0,0 +1,228 @@
+package act
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/timshannon/bolthold"
+)
+
+// ScrubReport summarizes a scrub of the local storage.
+type ScrubReport struct {
+	// Checked is the number of complete caches whose file was hashed.
+	Checked int
+	// Corrupt are the ids of the caches quarantined because their file does not match.
+	Corrupt []uint64
+	// Missing are the ids of the caches deleted because their file is gone.
+	Missing []uint64
+	// Orphaned are the files deleted because no cache refers to them.
+	Orphaned []string
+	// StaleTemp are the ids of the upload directories deleted because their upload is gone or abandoned.
+	StaleTemp []uint64
+}
+
+func (r *ScrubReport) String() string {
+	return fmt.Sprintf("checked %d, corrupt %d, missing %d, orphaned %d, stale uploads %d",
+		r.Checked, len(r.Corrupt), len(r.Missing), len(r.Orphaned), len(r.StaleTemp))
+}
+
+// Scrub checks the cache directory of a server which does not need to be running,
+// see Handler.scrub.
+func Scrub(dir string, logger logrus.FieldLogger) (*ScrubReport, error) {
+	if logger == nil {
+		discard := logrus.New()
+		discard.Out = io.Discard
+		logger = discard
+	}
+	keys, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	storage, err := NewStorage(filepath.Join(dir, "cache"), keys)
+	if err != nil {
+		return nil, err
+	}
+	h := &Handler{
+		dir:     dir,
+		storage: storage,
+		keys:    keys,
+		logger:  logger.WithField("module", "artifactcache"),
+	}
+	if err := h.migrateStorage(); err != nil {
+		return nil, err
+	}
+	return h.scrub()
+}
+
+// scrub re-hashes every blob referred to by a complete cache and reconciles the storage with the
+// database: caches whose blob does not match are quarantined, caches whose blob is gone are deleted,
+// and blobs, legacy files and upload directories which no cache refers to any more are removed.
+//
+// The database is only opened for short moments, so that the server keeps serving during a scrub.
+func (h *Handler) scrub() (*ScrubReport, error) {
+	report := &ScrubReport{}
+	started := time.Now()
+
+	db, err := h.openDB()
+	if err != nil {
+		return nil, err
+	}
+	var caches []*Cache
+	err = db.Find(&caches, nil)
+	db.Close()
+	if err != nil {
+		return nil, fmt.Errorf("find caches: %w", err)
+	}
+
+	type blobRef struct {
+		repo   string
+		digest string
+	}
+	type uploadRef struct {
+		repo string
+		id   uint64
+	}
+	// blobs holds the complete caches by the blob they share, referred holds every blob any cache
+	// refers to, quarantined ones included, and uploads every cache by its id.
+	blobs := map[blobRef][]*Cache{}
+	referred := map[blobRef]bool{}
+	uploads := map[uploadRef]*Cache{}
+	for _, cache := range caches {
+		uploads[uploadRef{cache.Repo, cache.ID}] = cache
+		if cache.Sha256 != "" {
+			referred[blobRef{cache.Repo, cache.Sha256}] = true
+		}
+		if cache.Complete && !cache.Quarantined {
+			ref := blobRef{cache.Repo, cache.Sha256}
+			blobs[ref] = append(blobs[ref], cache)
+		}
+	}
+
+	for ref, sharing := range blobs {
+		storage := h.storage.Namespace(ref.repo)
+
+		digest, err := storage.Hash(ref.digest)
+		switch {
+		case ref.digest == "" || os.IsNotExist(err):
+			for _, cache := range sharing {
+				cache := cache
+				report.Missing = append(report.Missing, cache.ID)
+				h.scrubUpdate(cache, func(db *bolthold.Store) error {
+					return deleteCache(db, cache.ID, cache)
+				})
+			}
+			continue
+		case errors.Is(err, errCorrupt):
+		case err != nil:
+			h.logger.Warnf("scrub blob %s: %v", ref.digest, err)
+			continue
+		}
+		report.Checked += len(sharing)
+
+		if err != nil || digest != ref.digest {
+			for _, cache := range sharing {
+				report.Corrupt = append(report.Corrupt, cache.ID)
+			}
+			h.logger.Errorf("quarantined blob %s: %v", ref.digest, errCorrupt)
+			h.scrubUpdate(sharing[0], func(db *bolthold.Store) error {
+				return quarantineCache(db, sharing[0])
+			})
+			if err := storage.Quarantine(ref.digest); err != nil {
+				h.logger.Warnf("quarantine blob %s: %v", ref.digest, err)
+			}
+		}
+	}
+
+	namespaces, err := h.storage.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, namespace := range append([]string{""}, namespaces...) {
+		storage := h.storage.Namespace(namespace)
+
+		var orphans []string
+		blobFiles, err := storage.blobFiles()
+		if err != nil {
+			return nil, err
+		}
+		quarantineFiles, err := storage.quarantineFiles()
+		if err != nil {
+			return nil, err
+		}
+		for _, files := range []map[string]string{blobFiles, quarantineFiles} {
+			for path, digest := range files {
+				if !referred[blobRef{namespace, digest}] {
+					orphans = append(orphans, path)
+				}
+			}
+		}
+		// migrated on startup, whatever is left no cache refers to
+		legacyFiles, err := storage.legacyFiles()
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, legacyFiles...)
+
+		for _, path := range orphans {
+			if info, err := os.Stat(path); err != nil || info.ModTime().After(started) {
+				// committed after the caches were listed
+				continue
+			}
+			report.Orphaned = append(report.Orphaned, path)
+			if err := os.Remove(path); err != nil {
+				h.logger.Warnf("remove orphan %s: %v", path, err)
+			}
+		}
+
+		dirs, err := storage.tempDirs()
+		if err != nil {
+			return nil, err
+		}
+		for id, modTime := range dirs {
+			// uploads in progress were written to recently, leftovers of complete caches are stale right away
+			if cache, ok := uploads[uploadRef{namespace, id}]; (!ok || !cache.Complete) && time.Since(modTime) < keepTemp {
+				continue
+			}
+			report.StaleTemp = append(report.StaleTemp, id)
+			storage.RemoveTemp(id)
+		}
+	}
+
+	h.logger.Infof("scrub: %v", report)
+	return report, nil
+}
+
+// scrubUpdate applies a change found by a scrub to the database.
+func (h *Handler) scrubUpdate(cache *Cache, update func(db *bolthold.Store) error) {
+	db, err := h.openDB()
+	if err != nil {
+		h.logger.Warnf("scrub cache %d: %v", cache.ID, err)
+		return
+	}
+	defer db.Close()
+	if err := update(db); err != nil {
+		h.logger.Warnf("scrub cache %d: %v", cache.ID, err)
+	}
+}
+
+// scrubLoop scrubs the storage every interval until the handler is shut down.
+func (h *Handler) scrubLoop(interval time.Duration) {
+	defer h.pending.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			if _, err := h.scrub(); err != nil {
+				h.logger.Warnf("scrub: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package act
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	signatureParam = "sig"
+	expiresParam   = "expires"
+)
+
+var (
+	errSignatureMissing = errors.New("missing signature")
+	errSignatureInvalid = errors.New("invalid signature")
+	errSignatureExpired = errors.New("signature expired")
+)
+
+// urlSigner signs the archive locations handed out by lookups, so that archives can only be
+// downloaded by clients which performed a lookup, and only for a limited time.
+type urlSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// newURLSigner reads the key from ACT_CACHE_URL_SECRET. Without it a random key is generated,
+// which invalidates the handed out locations on restart.
+func newURLSigner() (*urlSigner, error) {
+	signer := &urlSigner{
+		ttl: envDuration("ACT_CACHE_URL_TTL", time.Hour),
+	}
+	if v := os.Getenv("ACT_CACHE_URL_SECRET"); v != "" {
+		signer.key = []byte(v)
+	} else {
+		signer.key = make([]byte, 32)
+		if _, err := rand.Read(signer.key); err != nil {
+			return nil, fmt.Errorf("generate url secret: %w", err)
+		}
+	}
+	return signer, nil
+}
+
+func (s *urlSigner) signature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	_, _ = fmt.Fprintf(mac, "%s\n%d", path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the query which authorizes a GET of the unescaped path until the ttl passes.
+func (s *urlSigner) Sign(path string) string {
+	expires := time.Now().Add(s.ttl).Unix()
+	return url.Values{
+		expiresParam:   []string{strconv.FormatInt(expires, 10)},
+		signatureParam: []string{s.signature(path, expires)},
+	}.Encode()
+}
+
+// Verify checks the query of a request to the unescaped path.
+func (s *urlSigner) Verify(path string, query url.Values) error {
+	sig, expiresValue := query.Get(signatureParam), query.Get(expiresParam)
+	if sig == "" || expiresValue == "" {
+		return errSignatureMissing
+	}
+	expires, err := strconv.ParseInt(expiresValue, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.signature(path, expires))) {
+		return errSignatureInvalid
+	}
+	if time.Now().Unix() > expires {
+		return errSignatureExpired
+	}
+	return nil
+}
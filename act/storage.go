@@ -1,28 +1,62 @@
 package act
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
 )
 
+// Storage keeps committed archives as content-addressed blobs named after the sha256 of the
+// archive, so that caches with byte-identical archives share a single file. Uploads are staged
+// per cache id until they are committed.
 type Storage struct {
 	rootDir string
+	// keys encrypts committed files, files are stored in clear when nil.
+	keys *keyring
 }
 
-func NewStorage(rootDir string) (*Storage, error) {
+// Archive describes a committed file.
+type Archive struct {
+	// Size is the size of the archive as uploaded, before encryption.
+	Size int64
+	// KeyID is the id of the key the file is encrypted with, empty when stored in clear.
+	KeyID string
+	// Sha256 is the hex digest of the archive as uploaded, which names its blob.
+	Sha256 string
+}
+
+func NewStorage(rootDir string, keys *keyring) (*Storage, error) {
 	if err := os.MkdirAll(rootDir, 0o755); err != nil {
 		return nil, err
 	}
 	return &Storage{
 		rootDir: rootDir,
+		keys:    keys,
 	}, nil
 }
 
-func (s *Storage) Exist(id uint64) (bool, error) {
-	name := s.Filename(id)
+// Namespace returns the storage of a repository, rooted in its own directory so that
+// repositories never share files. The empty repository is the storage itself.
+func (s *Storage) Namespace(repo string) *Storage {
+	if repo == "" {
+		return s
+	}
+	return &Storage{
+		rootDir: filepath.Join(s.rootDir, "repos", filepath.FromSlash(repo)),
+		keys:    s.keys,
+	}
+}
+
+func (s *Storage) Exist(digest string) (bool, error) {
+	name := s.BlobName(digest)
 	if _, err := os.Stat(name); os.IsNotExist(err) {
 		return false, nil
 	} else if err != nil {
@@ -46,36 +80,113 @@ func (s *Storage) Write(id uint64, offset int64, reader io.Reader) error {
 	return err
 }
 
-func (s *Storage) Commit(id uint64, size int64) (int64, error) {
+// WriteBlob replaces whatever was uploaded for the id, parts and staged blocks alike, with an
+// upload of the whole archive.
+func (s *Storage) WriteBlob(id uint64, reader io.Reader) error {
+	if err := os.RemoveAll(s.tempDir(id)); err != nil {
+		return err
+	}
+	return s.Write(id, 0, reader)
+}
+
+// WriteBlock stages a block of an upload under its id, the block is only part of the upload once
+// listed by CommitBlocks.
+func (s *Storage) WriteBlock(id uint64, blockID string, reader io.Reader) error {
+	name := s.blockName(id, blockID)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	return err
+}
+
+// CommitBlocks lays the staged blocks out in the order of the list, as if each had been written at
+// its offset, and drops the blocks which are not listed. It returns the size of the upload.
+func (s *Storage) CommitBlocks(id uint64, blockIDs []string) (int64, error) {
+	sizes := make([]int64, len(blockIDs))
+	for i, blockID := range blockIDs {
+		if slices.Contains(blockIDs[:i], blockID) {
+			return 0, fmt.Errorf("block %q: %w", blockID, errInvalidBlockList)
+		}
+		info, err := os.Stat(s.blockName(id, blockID))
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("block %q: %w", blockID, errInvalidBlockList)
+		} else if err != nil {
+			return 0, err
+		}
+		sizes[i] = info.Size()
+	}
+
+	// a previous upload of the whole archive or of another list
+	parts, err := s.tempNames(id)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	for _, name := range parts {
+		if err := os.Remove(name); err != nil {
+			return 0, err
+		}
+	}
+
+	var offset int64
+	for i, blockID := range blockIDs {
+		if err := os.Rename(s.blockName(id, blockID), s.tempName(id, offset)); err != nil {
+			return 0, err
+		}
+		offset += sizes[i]
+	}
+	return offset, os.RemoveAll(filepath.Join(s.tempDir(id), "blocks"))
+}
+
+// Commit assembles the uploaded parts, encrypting them when keys are configured, and stores
+// the result as the blob of its digest. When the blob already exists, the assembled file is
+// dropped and the archive shares the existing blob.
+func (s *Storage) Commit(id uint64, size int64) (*Archive, error) {
 	defer func() {
 		_ = os.RemoveAll(s.tempDir(id))
 	}()
 
-	name := s.Filename(id)
 	tempNames, err := s.tempNames(id)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
-		return 0, err
-	}
+	name := filepath.Join(s.tempDir(id), "archive")
 	file, err := os.Create(name)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer file.Close()
 
+	archive := &Archive{}
+	var dst io.Writer = file
+	var encrypter io.WriteCloser
+	if s.keys != nil {
+		encrypter, archive.KeyID, err = s.keys.Encrypt(file)
+		if err != nil {
+			return nil, err
+		}
+		dst = encrypter
+	}
+	digest := sha256.New()
+	dst = io.MultiWriter(dst, digest)
+
 	var written int64
 	for _, v := range tempNames {
 		f, err := os.Open(v)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		n, err := io.Copy(file, f)
+		n, err := io.Copy(dst, f)
 		_ = f.Close()
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		written += n
 	}
@@ -84,25 +195,209 @@ func (s *Storage) Commit(id uint64, size int64) (int64, error) {
 	// We can't check the size of the file, just skip the check.
 	// It happens when the request comes from old versions of actions, like `actions/cache@v2`.
 	if size >= 0 && written != size {
-		_ = file.Close()
-		_ = os.Remove(name)
-		return 0, fmt.Errorf("broken file: %v != %v", written, size)
+		return nil, fmt.Errorf("broken file: %v != %v", written, size)
+	}
+
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	archive.Size = written
+	archive.Sha256 = hex.EncodeToString(digest.Sum(nil))
+
+	if archive.KeyID, err = s.store(name, archive.Sha256); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// store moves a file into the blob of the digest, unless the blob already exists. It returns the
+// id of the key the blob is encrypted with, read from the blob as it may be one stored before with
+// another key, or the plaintext of a legacy cache. The blob is touched either way, as a scrub only
+// removes orphans older than its start and a blob keeps the time of the upload it was written by.
+func (s *Storage) store(name string, digest string) (string, error) {
+	blob := s.BlobName(digest)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(name, blob); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	if err := touch(blob); err != nil {
+		return "", err
+	}
+	return fileKeyID(blob)
+}
+
+// fileKeyID returns the id of the key a file is encrypted with, or an empty string when it is not.
+func fileKeyID(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	header, err := readEncHeader(file)
+	if errors.Is(err, errNotEncrypted) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return header.keyID, nil
+}
+
+// encryptFile encrypts a plaintext file in place with the active key, files which are already
+// encrypted are left as they are.
+func (s *Storage) encryptFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := readEncHeader(file); !errors.Is(err, errNotEncrypted) {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	sealed, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sealed.Name())
+	defer sealed.Close()
+	encrypter, _, err := s.keys.Encrypt(sealed)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encrypter, file); err != nil {
+		return err
+	}
+	if err := encrypter.Close(); err != nil {
+		return err
+	}
+	if err := sealed.Close(); err != nil {
+		return err
+	}
+	return os.Rename(sealed.Name(), name)
+}
+
+// Serve serves the archive as uploaded, encrypted files are decrypted on the fly.
+// Full downloads are verified against the digest, a mismatch cuts the response short and is
+// reported as errCorrupt. Ranges are served unverified.
+func (s *Storage) Serve(w http.ResponseWriter, r *http.Request, digest string) error {
+	file, err := os.Open(s.BlobName(digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return nil
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	defer file.Close()
+	return s.serveFile(w, r, file, digest)
+}
+
+// serveFile serves an archive like Serve, full downloads are only verified when the digest is known.
+func (s *Storage) serveFile(w http.ResponseWriter, r *http.Request, file *os.File, digest string) error {
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	var content io.ReadSeeker = file
+	size := info.Size()
+	if plain, plainSize, _, err := s.keys.Open(file, info.Size()); err == nil {
+		content, size = plain, plainSize
+	} else if !errors.Is(err, errNotEncrypted) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	// archives are opaque, skip the content sniffing of ServeContent
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if r.Header.Get("Range") != "" || r.Method != http.MethodGet || digest == "" {
+		http.ServeContent(w, r, "", info.ModTime(), content)
+		return nil
 	}
 
-	return written, nil
+	verifier := newVerifyReader(content, digest)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, verifier)
+	if verifier.Corrupt() {
+		return errCorrupt
+	}
+	return err
 }
 
-func (s *Storage) Serve(w http.ResponseWriter, r *http.Request, id uint64) {
-	name := s.Filename(id)
-	http.ServeFile(w, r, name)
+// Remove removes a blob, the caller makes sure no cache refers to it any more.
+func (s *Storage) Remove(digest string) {
+	_ = os.Remove(s.BlobName(digest))
 }
 
-func (s *Storage) Remove(id uint64) {
-	_ = os.Remove(s.Filename(id))
+// Quarantine moves a corrupt blob aside for inspection, so that a later commit of the same
+// archive stores a sound blob again.
+func (s *Storage) Quarantine(digest string) error {
+	name := s.quarantineName(digest)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(s.BlobName(digest), name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CreateFetch creates a file to fetch an archive of the remote tier into, the caller removes it
+// once served. Files left behind by a previous run are removed by ClearFetches.
+func (s *Storage) CreateFetch() (*os.File, error) {
+	dir := filepath.Join(s.rootDir, "fetch")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, "remote-*")
+}
+
+// ServeFetch serves an archive fetched into a file created by CreateFetch, see Serve.
+func (s *Storage) ServeFetch(w http.ResponseWriter, r *http.Request, file *os.File, digest string) error {
+	return s.serveFile(w, r, file, digest)
+}
+
+// ClearFetches removes the files of fetches which did not complete.
+func (s *Storage) ClearFetches() error {
+	return os.RemoveAll(filepath.Join(s.rootDir, "fetch"))
+}
+
+// RemoveTemp removes the staged uploads of a cache.
+func (s *Storage) RemoveTemp(id uint64) {
 	_ = os.RemoveAll(s.tempDir(id))
 }
 
-func (s *Storage) Filename(id uint64) string {
+func (s *Storage) BlobName(digest string) string {
+	if len(digest) < 2 {
+		return filepath.Join(s.rootDir, "blobs", "sha256", digest)
+	}
+	return filepath.Join(s.rootDir, "blobs", "sha256", digest[:2], digest)
+}
+
+func (s *Storage) quarantineName(digest string) string {
+	return filepath.Join(s.rootDir, "quarantine", digest)
+}
+
+// legacyName is where archives were stored by cache id, before storage was content-addressed.
+func (s *Storage) legacyName(id uint64) string {
 	return filepath.Join(s.rootDir, fmt.Sprintf("%02x", id%0xff), fmt.Sprint(id))
 }
 
@@ -114,6 +409,11 @@ func (s *Storage) tempName(id uint64, offset int64) string {
 	return filepath.Join(s.tempDir(id), fmt.Sprintf("%016x", offset))
 }
 
+func (s *Storage) blockName(id uint64, blockID string) string {
+	// block ids are base64, which is not safe in file names
+	return filepath.Join(s.tempDir(id), "blocks", hex.EncodeToString([]byte(blockID)))
+}
+
 func (s *Storage) tempNames(id uint64) ([]string, error) {
 	dir := s.tempDir(id)
 	files, err := os.ReadDir(dir)
@@ -122,9 +422,197 @@ func (s *Storage) tempNames(id uint64) ([]string, error) {
 	}
 	var names []string
 	for _, v := range files {
-		if !v.IsDir() {
+		// only the uploaded parts, which are named after their offset
+		if _, err := strconv.ParseUint(v.Name(), 16, 64); err == nil && !v.IsDir() {
 			names = append(names, filepath.Join(dir, v.Name()))
 		}
 	}
 	return names, nil
 }
+
+// Hash returns the hex sha256 of a blob as uploaded, decrypting it when encrypted.
+func (s *Storage) Hash(digest string) (string, error) {
+	return s.hashFile(s.BlobName(digest))
+}
+
+func (s *Storage) hashFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	var content io.Reader = file
+	if plain, _, _, err := s.keys.Open(file, info.Size()); err == nil {
+		content = plain
+	} else if !errors.Is(err, errNotEncrypted) {
+		return "", err
+	}
+	digest := sha256.New()
+	if _, err := io.Copy(digest, content); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// Migrate moves the archive of a cache from its legacy per id file into its blob, hashing it when
+// the digest is unknown and encrypting it when keys are configured. It returns the archive, or
+// nil when the cache has no legacy file.
+func (s *Storage) Migrate(id uint64, digest string) (*Archive, error) {
+	name := s.legacyName(id)
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if digest == "" {
+		var err error
+		if digest, err = s.hashFile(name); err != nil {
+			return nil, err
+		}
+	}
+	if s.keys != nil {
+		if err := s.encryptFile(name); err != nil {
+			return nil, err
+		}
+	}
+	keyID, err := s.store(name, digest)
+	if err != nil {
+		return nil, err
+	}
+	// the blob already existed when the file is still there
+	_ = os.Remove(name)
+	return &Archive{
+		KeyID:  keyID,
+		Sha256: digest,
+	}, nil
+}
+
+// Namespaces lists the repositories which have files in the storage.
+func (s *Storage) Namespaces() ([]string, error) {
+	owners, err := os.ReadDir(filepath.Join(s.rootDir, "repos"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var repos []string
+	for _, owner := range owners {
+		if !owner.IsDir() {
+			continue
+		}
+		names, err := os.ReadDir(filepath.Join(s.rootDir, "repos", owner.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if name.IsDir() {
+				repos = append(repos, owner.Name()+"/"+name.Name())
+			}
+		}
+	}
+	return repos, nil
+}
+
+// blobFiles lists the files of the blob directory by path, along with the digest they are named after.
+func (s *Storage) blobFiles() (map[string]string, error) {
+	root := filepath.Join(s.rootDir, "blobs", "sha256")
+	shards, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(root, shard.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			files[filepath.Join(root, shard.Name(), entry.Name())] = entry.Name()
+		}
+	}
+	return files, nil
+}
+
+// quarantineFiles lists the quarantined blobs by path, along with their digest.
+func (s *Storage) quarantineFiles() (map[string]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.rootDir, "quarantine"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, entry := range entries {
+		files[s.quarantineName(entry.Name())] = entry.Name()
+	}
+	return files, nil
+}
+
+// legacyFiles lists the files left in the shard directories of the per id layout.
+func (s *Storage) legacyFiles() ([]string, error) {
+	shards, err := os.ReadDir(s.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShardName(shard.Name()) {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.rootDir, shard.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			files = append(files, filepath.Join(s.rootDir, shard.Name(), entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// tempDirs lists the upload directories by id, along with their last modification.
+func (s *Storage) tempDirs() (map[uint64]time.Time, error) {
+	entries, err := os.ReadDir(filepath.Join(s.rootDir, "tmp"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	dirs := map[uint64]time.Time{}
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		dirs[id] = info.ModTime()
+	}
+	return dirs, nil
+}
+
+func isShardName(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := strconv.ParseUint(name, 16, 8)
+	return err == nil
+}
+
+// touch sets the modification time of a file to now.
+func touch(name string) error {
+	now := time.Now()
+	return os.Chtimes(name, now, now)
+}
@@ -0,0 +1,127 @@
+package act
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// commitTestArchive uploads content as the cache of the id and commits it.
+func commitTestArchive(t *testing.T, s *Storage, id uint64, content string) *Archive {
+	t.Helper()
+	if err := s.Write(id, 0, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := s.Commit(id, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+// expectTouched fails unless the file was modified after the time.
+func expectTouched(t *testing.T, name string, after time.Time) {
+	t.Helper()
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Before(after) {
+		t.Fatalf("%s modified at %v, before %v", name, info.ModTime(), after)
+	}
+}
+
+func TestStoreTouchesBlob(t *testing.T) {
+	s, err := NewStorage(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+
+	started := time.Now()
+	archive := commitTestArchive(t, s, 1, "content")
+	blob := s.BlobName(archive.Sha256)
+	expectTouched(t, blob, started)
+
+	// a scrub started before the blob is shared again must not take it for an orphan
+	if err := os.Chtimes(blob, old, old); err != nil {
+		t.Fatal(err)
+	}
+	started = time.Now()
+	if shared := commitTestArchive(t, s, 2, "content"); shared.Sha256 != archive.Sha256 {
+		t.Fatalf("digest %s, want %s", shared.Sha256, archive.Sha256)
+	}
+	expectTouched(t, blob, started)
+
+	legacy := s.legacyName(3)
+	if err := os.MkdirAll(filepath.Dir(legacy), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacy, []byte("legacy"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(legacy, old, old); err != nil {
+		t.Fatal(err)
+	}
+	started = time.Now()
+	migrated, err := s.Migrate(3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTouched(t, s.BlobName(migrated.Sha256), started)
+}
+
+// writeLegacy writes the file of a cache stored before blobs.
+func writeLegacy(t *testing.T, s *Storage, id uint64, content string) {
+	t.Helper()
+	name := s.legacyName(id)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateKeyID(t *testing.T) {
+	plain, err := NewStorage(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLegacy(t, plain, 1, "legacy")
+	if archive, err := plain.Migrate(1, ""); err != nil || archive.KeyID != "" {
+		t.Fatalf("migrate without keys: %+v, %v", archive, err)
+	}
+
+	s, err := NewStorage(t.TempDir(), testKeyring("k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLegacy(t, s, 1, "legacy")
+	archive, err := s.Migrate(1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.KeyID != "k1" {
+		t.Fatalf("key id %q, want k1", archive.KeyID)
+	}
+	if keyID, err := fileKeyID(s.BlobName(archive.Sha256)); err != nil || keyID != "k1" {
+		t.Fatalf("blob encrypted with %q, %v, want k1", keyID, err)
+	}
+	if digest, err := s.Hash(archive.Sha256); err != nil || digest != archive.Sha256 {
+		t.Fatalf("hash %s, %v, want %s", digest, err, archive.Sha256)
+	}
+
+	// a blob stored before keys were configured stays plaintext, and is recorded so
+	writeLegacy(t, plain, 2, "shared")
+	shared, err := plain.Migrate(2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyed := &Storage{rootDir: plain.rootDir, keys: testKeyring("k1")}
+	if archive := commitTestArchive(t, keyed, 3, "shared"); archive.Sha256 != shared.Sha256 || archive.KeyID != "" {
+		t.Fatalf("deduplicated archive %+v, want the plaintext blob", archive)
+	}
+}
@@ -0,0 +1,100 @@
+package act
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate of a cert and key file pair, reloading it whenever
+// one of the files changes so that renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	// fail early on a broken pair instead of on the first handshake
+	if _, err := c.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// the files are most likely being replaced, keep serving the previous pair
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	return c.cert, nil
+}
+
+// loadTLSConfig builds the listener TLS config from the environment, it returns nil when
+// ACT_CACHE_TLS_CERT and ACT_CACHE_TLS_KEY are unset and the server speaks plain HTTP.
+// With ACT_CACHE_TLS_CLIENT_CA set, clients must present a certificate signed by the bundle.
+func loadTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("ACT_CACHE_TLS_CERT"), os.Getenv("ACT_CACHE_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("ACT_CACHE_TLS_CERT and ACT_CACHE_TLS_KEY must be set together")
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if caFile := os.Getenv("ACT_CACHE_TLS_CLIENT_CA"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
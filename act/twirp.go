@@ -0,0 +1,287 @@
+package act
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// twirpBase is the route prefix of the cache service of the results API, which newer versions
+	// of actions/cache talk to at ACTIONS_RESULTS_URL instead of the artifactcache API.
+	twirpBase = "/twirp/github.actions.results.api.v1.CacheService"
+)
+
+// Twirp error codes, see https://twitchtv.github.io/twirp/docs/spec_v7.html#error-codes
+const (
+	twirpMalformed       = "malformed"
+	twirpInvalidArgument = "invalid_argument"
+	twirpNotFound        = "not_found"
+	twirpAlreadyExists   = "already_exists"
+	twirpPermission      = "permission_denied"
+	twirpInternal        = "internal"
+)
+
+var twirpStatus = map[string]int{
+	twirpMalformed:       400,
+	twirpInvalidArgument: 400,
+	twirpNotFound:        404,
+	twirpAlreadyExists:   409,
+	twirpPermission:      403,
+	twirpInternal:        500,
+}
+
+// protoInt64 is an int64 field of a protobuf message, which the JSON mapping encodes as a string.
+type protoInt64 int64
+
+func (i protoInt64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+func (i *protoInt64) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" || s == "" {
+		*i = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid int64 %s", data)
+	}
+	*i = protoInt64(v)
+	return nil
+}
+
+type cacheMetadata struct {
+	RepositoryID protoInt64   `json:"repositoryId"`
+	Scope        []cacheScope `json:"scope"`
+}
+
+type cacheScope struct {
+	Scope      string     `json:"scope"`
+	Permission protoInt64 `json:"permission"`
+}
+
+type createCacheEntryRequest struct {
+	Metadata *cacheMetadata `json:"metadata"`
+	Key      string         `json:"key"`
+	Version  string         `json:"version"`
+}
+
+type createCacheEntryResponse struct {
+	Ok              bool   `json:"ok"`
+	SignedUploadURL string `json:"signedUploadUrl"`
+	Message         string `json:"message,omitempty"`
+}
+
+type finalizeCacheEntryUploadRequest struct {
+	Metadata  *cacheMetadata `json:"metadata"`
+	Key       string         `json:"key"`
+	SizeBytes protoInt64     `json:"sizeBytes"`
+	Version   string         `json:"version"`
+}
+
+type finalizeCacheEntryUploadResponse struct {
+	Ok      bool       `json:"ok"`
+	EntryID protoInt64 `json:"entryId"`
+	Message string     `json:"message,omitempty"`
+}
+
+type getCacheEntryDownloadURLRequest struct {
+	Metadata    *cacheMetadata `json:"metadata"`
+	Key         string         `json:"key"`
+	RestoreKeys []string       `json:"restoreKeys"`
+	Version     string         `json:"version"`
+}
+
+type getCacheEntryDownloadURLResponse struct {
+	Ok                bool   `json:"ok"`
+	SignedDownloadURL string `json:"signedDownloadUrl"`
+	MatchedKey        string `json:"matchedKey"`
+}
+
+// POST /twirp/github.actions.results.api.v1.CacheService/CreateCacheEntry
+func (h *Handler) routeCreateCacheEntry(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	req := &createCacheEntryRequest{}
+	sc, err := h.twirpRequest(r, params, req, func() *cacheMetadata { return req.Metadata })
+	if err != nil {
+		h.twirpError(w, r, twirpMalformed, err)
+		return
+	}
+	if req.Key == "" || req.Version == "" {
+		h.twirpError(w, r, twirpInvalidArgument, errors.New("key and version are required"))
+		return
+	}
+	if !h.policies.of(r).save {
+		if h.policies.ignore {
+			// the upload URL takes the archive and drops it
+			h.responseJSON(w, r, 200, &createCacheEntryResponse{
+				Ok:              true,
+				SignedUploadURL: h.signedURL(fmt.Sprintf("%s/uploads/%d", repoURLBase(sc.Repo), discardID)),
+			})
+		} else {
+			h.twirpError(w, r, twirpPermission, errSaveDenied)
+		}
+		return
+	}
+
+	cache, err := h.reserve(sc, &Request{Key: req.Key, Version: req.Version})
+	if errors.Is(err, errCacheExists) || errors.Is(err, errReserved) {
+		h.twirpError(w, r, twirpAlreadyExists, err)
+		return
+	} else if err != nil {
+		h.twirpError(w, r, twirpInternal, err)
+		return
+	}
+	h.responseJSON(w, r, 200, &createCacheEntryResponse{
+		Ok:              true,
+		SignedUploadURL: h.signedURL(fmt.Sprintf("%s/uploads/%d", repoURLBase(sc.Repo), cache.ID)),
+	})
+}
+
+// POST /twirp/github.actions.results.api.v1.CacheService/FinalizeCacheEntryUpload
+func (h *Handler) routeFinalizeCacheEntryUpload(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	req := &finalizeCacheEntryUploadRequest{}
+	sc, err := h.twirpRequest(r, params, req, func() *cacheMetadata { return req.Metadata })
+	if err != nil {
+		h.twirpError(w, r, twirpMalformed, err)
+		return
+	}
+	policy := h.policies.of(r)
+	if !policy.save {
+		if h.policies.ignore {
+			h.responseJSON(w, r, 200, &finalizeCacheEntryUploadResponse{
+				Ok:      true,
+				EntryID: protoInt64(discardID),
+			})
+		} else {
+			h.twirpError(w, r, twirpPermission, errSaveDenied)
+		}
+		return
+	}
+
+	db, err := h.openDB()
+	if err != nil {
+		h.twirpError(w, r, twirpInternal, err)
+		return
+	}
+	cache, err := findReservedCache(db, sc.Repo, sc.Ref, strings.ToLower(req.Key), req.Version)
+	db.Close()
+	if err != nil {
+		h.twirpError(w, r, twirpInternal, err)
+		return
+	}
+	if cache == nil {
+		h.twirpError(w, r, twirpNotFound, fmt.Errorf("cache %q: %w", req.Key, errNotReserved))
+		return
+	}
+
+	cache.Size = int64(req.SizeBytes)
+	if err := h.commit(cache, policy.push); err != nil {
+		h.twirpError(w, r, twirpInternal, err)
+		return
+	}
+	h.responseJSON(w, r, 200, &finalizeCacheEntryUploadResponse{
+		Ok:      true,
+		EntryID: protoInt64(cache.ID),
+	})
+}
+
+// POST /twirp/github.actions.results.api.v1.CacheService/GetCacheEntryDownloadURL
+func (h *Handler) routeGetCacheEntryDownloadURL(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	req := &getCacheEntryDownloadURLRequest{}
+	sc, err := h.twirpRequest(r, params, req, func() *cacheMetadata { return req.Metadata })
+	if err != nil {
+		h.twirpError(w, r, twirpMalformed, err)
+		return
+	}
+
+	if !h.policies.of(r).restore {
+		if h.policies.ignore {
+			h.responseJSON(w, r, 200, &getCacheEntryDownloadURLResponse{})
+		} else {
+			h.twirpError(w, r, twirpPermission, errRestoreDenied)
+		}
+		return
+	}
+
+	location, key, err := h.lookup(sc, append([]string{req.Key}, req.RestoreKeys...), req.Version)
+	if err != nil {
+		h.twirpError(w, r, twirpInternal, err)
+		return
+	}
+	// a miss is not an error, the client expects ok to be false
+	h.responseJSON(w, r, 200, &getCacheEntryDownloadURLResponse{
+		Ok:                location != "",
+		SignedDownloadURL: location,
+		MatchedKey:        key,
+	})
+}
+
+// twirpRequest decodes the JSON body of a Twirp request and resolves its scope. The refs are taken
+// from the metadata of the request when neither the token nor the headers carry them.
+func (h *Handler) twirpRequest(r *http.Request, params httprouter.Params, v any, metadata func() *cacheMetadata) (*scope, error) {
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType != "application/json" {
+		return nil, fmt.Errorf("unsupported content type %q, only JSON is supported", contentType)
+	}
+	// the JSON mapping of protobuf accepts the original field names as well as the camel cased
+	// ones, dropping the underscores lets the case insensitive decoding match either
+	var body any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(protoFieldNames(body))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+
+	sc, err := requestScope(r, params)
+	if err != nil {
+		return nil, err
+	}
+	if m := metadata(); m != nil && sc.Ref == "" && len(sc.RestoreRefs) == 0 {
+		scopes := make([]accessScope, 0, len(m.Scope))
+		for _, s := range m.Scope {
+			scopes = append(scopes, accessScope{Scope: s.Scope, Permission: int(s.Permission)})
+		}
+		sc.Ref, sc.RestoreRefs = scopeRefs(scopes)
+	}
+	return sc, nil
+}
+
+// protoFieldNames drops the underscores from the object keys of a decoded JSON value.
+func protoFieldNames(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		fields := make(map[string]any, len(v))
+		for key, value := range v {
+			fields[strings.ReplaceAll(key, "_", "")] = protoFieldNames(value)
+		}
+		return fields
+	case []any:
+		for i, value := range v {
+			v[i] = protoFieldNames(value)
+		}
+	}
+	return v
+}
+
+// twirpError responds with a Twirp error.
+func (h *Handler) twirpError(w http.ResponseWriter, r *http.Request, code string, err error) {
+	h.logger.Errorf("%v %v: %v", r.Method, r.RequestURI, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(twirpStatus[code])
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"code": code,
+		"msg":  err.Error(),
+	})
+}
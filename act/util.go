@@ -2,8 +2,10 @@ package act
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func parseContentRange(s string) (int64, int64, error) {
@@ -21,3 +23,65 @@ func parseContentRange(s string) (int64, int64, error) {
 	}
 	return start, stop, nil
 }
+
+// envDuration reads a duration like "90s" from the environment, falling back when unset or invalid.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
+
+// envSize reads a size in bytes like "4MiB" or "512k" from the environment, falling back when
+// unset or invalid.
+func envSize(name string, fallback int64) int64 {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	v = strings.ToLower(strings.TrimSpace(v))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "b"), "i")
+	unit := int64(1)
+	for suffix, size := range map[string]int64{"k": 1 << 10, "m": 1 << 20, "g": 1 << 30} {
+		if strings.HasSuffix(v, suffix) {
+			v, unit = strings.TrimSuffix(v, suffix), size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return fallback
+	}
+	return n * unit
+}
+
+// envInt reads an integer from the environment, falling back when unset or invalid.
+func envInt(name string, fallback int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// envBool reads a boolean like "true" or "1" from the environment, falling back when unset or invalid.
+func envBool(name string, fallback bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return fallback
+	}
+	return b
+}
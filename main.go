@@ -10,8 +10,12 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
+// defaultShutdownGrace is how long in-flight transfers and remote pushes get to finish on shutdown.
+const defaultShutdownGrace = 30 * time.Second
+
 func main() {
 	ctx := context.Background()
 
@@ -28,28 +32,67 @@ func main() {
 		CacheHomeDir = filepath.Join(userHomeDir, ".cache")
 	}
 
+	shutdownGrace := defaultShutdownGrace
+	if v := os.Getenv("ACT_CACHE_SHUTDOWN_GRACE"); v != "" {
+		if shutdownGrace, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("ACT_CACHE_SHUTDOWN_GRACE: %v", err)
+		}
+	}
+
 	cacheServerAddr := common.GetOutboundIP().String()
 	cacheServerPath := filepath.Join(CacheHomeDir, "actcache")
+
+	if len(os.Args) > 1 && os.Args[1] == "scrub" {
+		report, err := act.Scrub(cacheServerPath, common.Logger(ctx))
+		if err != nil {
+			fmt.Printf("Error %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Scrub complete: %v\n", report)
+		for _, id := range report.Corrupt {
+			fmt.Printf("  corrupt cache %d, quarantined\n", id)
+		}
+		for _, id := range report.Missing {
+			fmt.Printf("  missing cache %d, deleted\n", id)
+		}
+		for _, path := range report.Orphaned {
+			fmt.Printf("  orphaned file %s, deleted\n", path)
+		}
+		return
+	}
 	var cacheServerPort uint16 = 9900
 
 	handler, err := act.StartHandler(cacheServerPath, cacheServerAddr, cacheServerPort, common.Logger(ctx))
-	if err == nil {
-		fmt.Printf("%v\n", handler.ExternalURL())
-	} else {
-		fmt.Printf("Error %v", err)
+	if err != nil {
+		fmt.Printf("Error %v\n", err)
+		os.Exit(1)
 	}
+	fmt.Printf("%v\n", handler.ExternalURL())
 
 	// Prepare to catch signals
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+	shutdown := make(chan error, 1)
 	go func() {
 		<-sigs
 		// Signal received, initiate graceful shutdown
 		fmt.Println("\nSignal received, shutting down...")
-		handler.Close()
+		// a second signal skips the grace period
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+
+		ctx, cancel := context.WithTimeout(ctx, shutdownGrace)
+		defer cancel()
+		shutdown <- handler.Shutdown(ctx)
 	}()
 
-	handler.Serve()
-	//defer handler.Close()
+	if err := handler.Serve(); err != nil {
+		os.Exit(1)
+	}
+	if err := <-shutdown; err != nil {
+		fmt.Printf("Shutdown incomplete: %v\n", err)
+		_ = handler.Close()
+		os.Exit(1)
+	}
+	fmt.Println("Shutdown complete")
 }
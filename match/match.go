@@ -0,0 +1,51 @@
+// Package match implements the rule a lookup picks a cache by. Both the local database and Nexus
+// use it, so that both tiers restore the same cache for the same keys and version.
+package match
+
+import (
+	"strings"
+	"time"
+)
+
+// Candidate is a cache a lookup may pick.
+type Candidate struct {
+	Key     string
+	Version string
+	// Created orders the caches of a key, the newest one is picked, the last one listed on a tie.
+	Created time.Time
+}
+
+// Find returns the index of the candidate picked for the keys and version, or -1 when none matches.
+//
+// The keys are tried in order, each first for a cache with exactly that key and then for a cache
+// whose key starts with it, like GitHub matches the key and the restore keys. Only caches of the
+// version are ever picked, so that an archive is never restored by a job which could not read it.
+func Find(keys []string, version string, candidates []Candidate) int {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		for _, exact := range []bool{true, false} {
+			picked := -1
+			for i, c := range candidates {
+				if c.Version != version || !matches(c.Key, key, exact) {
+					continue
+				}
+				if picked < 0 || !c.Created.Before(candidates[picked].Created) {
+					picked = i
+				}
+			}
+			if picked >= 0 {
+				return picked
+			}
+		}
+	}
+	return -1
+}
+
+func matches(candidate string, key string, exact bool) bool {
+	if exact {
+		return candidate == key
+	}
+	return strings.HasPrefix(candidate, key)
+}
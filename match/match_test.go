@@ -0,0 +1,42 @@
+package match_test
+
+import (
+	"act-nexus-cache/match"
+	"act-nexus-cache/match/matchtest"
+	"testing"
+	"time"
+)
+
+func TestFind(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range matchtest.Cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var candidates []match.Candidate
+			for i, cache := range tc.Caches {
+				candidates = append(candidates, match.Candidate{
+					Key:     cache.Key,
+					Version: cache.Version,
+					Created: created.Add(time.Duration(i) * time.Second),
+				})
+			}
+			got := ""
+			if i := match.Find(tc.Keys, tc.Version, candidates); i >= 0 {
+				got = candidates[i].Key
+			}
+			if got != tc.Want {
+				t.Errorf("Find(%q, %q) = %q, want %q", tc.Keys, tc.Version, got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestFindTie(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	candidates := []match.Candidate{
+		{Key: "linux-a", Version: "v1", Created: created},
+		{Key: "linux-b", Version: "v1", Created: created},
+	}
+	if i := match.Find([]string{"linux-"}, "v1", candidates); i != 1 {
+		t.Errorf("Find picked %d, want the last one listed", i)
+	}
+}
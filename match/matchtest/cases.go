@@ -0,0 +1,100 @@
+// Package matchtest holds the lookups every tier must answer alike, the tests of the local
+// database and of Nexus run them against their own storage.
+package matchtest
+
+// Cache is a cache saved before a lookup, the caches of a case are saved oldest first.
+type Cache struct {
+	Key     string
+	Version string
+}
+
+// Case is a lookup of the keys and version among the caches, Want is the key of the cache it
+// finds, or "" for a miss.
+type Case struct {
+	Name    string
+	Caches  []Cache
+	Keys    []string
+	Version string
+	Want    string
+}
+
+// Cases are the lookups of the shared table.
+var Cases = []Case{
+	{
+		Name:    "exact key",
+		Caches:  []Cache{{"linux-node", "v1"}},
+		Keys:    []string{"linux-node"},
+		Version: "v1",
+		Want:    "linux-node",
+	},
+	{
+		Name:    "exact key before a newer prefix match",
+		Caches:  []Cache{{"linux-node", "v1"}, {"linux-node-modules", "v1"}},
+		Keys:    []string{"linux-node"},
+		Version: "v1",
+		Want:    "linux-node",
+	},
+	{
+		Name:    "prefix match, newest wins",
+		Caches:  []Cache{{"linux-a", "v1"}, {"linux-b", "v1"}, {"linux-c", "v2"}},
+		Keys:    []string{"linux-"},
+		Version: "v1",
+		Want:    "linux-b",
+	},
+	{
+		Name:    "newest wins regardless of the order of keys",
+		Caches:  []Cache{{"linux-b", "v1"}, {"linux-a", "v1"}},
+		Keys:    []string{"linux-"},
+		Version: "v1",
+		Want:    "linux-a",
+	},
+	{
+		Name:    "restore key after a missing primary key",
+		Caches:  []Cache{{"linux-a", "v1"}, {"linux-b", "v1"}},
+		Keys:    []string{"linux-x", "linux-"},
+		Version: "v1",
+		Want:    "linux-b",
+	},
+	{
+		Name:    "primary key before a newer restore key match",
+		Caches:  []Cache{{"linux-a", "v1"}, {"linux-b", "v1"}},
+		Keys:    []string{"linux-a", "linux-"},
+		Version: "v1",
+		Want:    "linux-a",
+	},
+	{
+		Name:    "prefix of the primary key before a restore key",
+		Caches:  []Cache{{"linux-a-1", "v1"}, {"linux-b", "v1"}},
+		Keys:    []string{"linux-a", "linux-"},
+		Version: "v1",
+		Want:    "linux-a-1",
+	},
+	{
+		Name:    "exact key of another version",
+		Caches:  []Cache{{"linux-a", "v2"}},
+		Keys:    []string{"linux-a"},
+		Version: "v1",
+		Want:    "",
+	},
+	{
+		Name:    "prefix match of another version",
+		Caches:  []Cache{{"linux-a", "v1"}, {"linux-b", "v2"}},
+		Keys:    []string{"linux-"},
+		Version: "v2",
+		Want:    "linux-b",
+	},
+	{
+		Name:    "dashed versions",
+		Caches:  []Cache{{"linux", "v-1"}, {"linux-v", "1"}},
+		Keys:    []string{"linux"},
+		Version: "v-1",
+		Want:    "linux",
+	},
+	{
+		Name:    "no match",
+		Caches:  []Cache{{"linux-a", "v1"}},
+		Keys:    []string{"windows-", "macos-"},
+		Version: "v1",
+		Want:    "",
+	},
+}
@@ -0,0 +1,72 @@
+package nexus
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// gear maps every byte to a random value for the rolling hash of the chunker, it must never change
+// as boundaries and thereby the chunks already uploaded depend on it.
+var gear = func() (table [256]uint64) {
+	// splitmix64 with a fixed seed
+	seed := uint64(0x6163742d6e657875)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream at content-defined boundaries with a gear hash: a boundary is placed
+// where the hash of the last 64 bytes has its top bits cleared, so an insertion or deletion only
+// moves the boundaries around it and the chunks before and after it stay the same.
+type chunker struct {
+	r    *bufio.Reader
+	min  int
+	max  int
+	mask uint64
+	buf  []byte
+}
+
+// newChunker returns a chunker whose chunks average size bytes, bounded to a quarter and four times
+// the average. size is rounded down to a power of two.
+func newChunker(r io.Reader, size int) *chunker {
+	shift := bits.Len(uint(size)) - 1
+	return &chunker{
+		r:    bufio.NewReaderSize(r, 1<<20),
+		min:  size / 4,
+		max:  size * 4,
+		mask: ^uint64(0) << (64 - shift),
+		buf:  make([]byte, 0, size*4),
+	}
+}
+
+// Next returns the next chunk, which is only valid until the following call, or io.EOF at the end
+// of the stream.
+func (c *chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+	for len(c.buf) < c.max {
+		b, err := c.r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = hash<<1 + gear[b]
+		if len(c.buf) >= c.min && hash&c.mask == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
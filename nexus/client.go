@@ -0,0 +1,80 @@
+package nexus
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientOptions configure the HTTP client a CacheService sends its requests with.
+type ClientOptions struct {
+	// ConnectTimeout bounds dialing and the TLS handshake, ResponseTimeout the wait for the headers
+	// of a response once the request is sent.
+	ConnectTimeout  time.Duration
+	ResponseTimeout time.Duration
+
+	// Proxy returns the proxy of a request, the proxy of the environment is used when nil.
+	Proxy func(*http.Request) (*url.URL, error)
+	// TLS holds the CA bundle and the client certificate, the system roots are used when nil.
+	TLS *tls.Config
+
+	// MaxConnsPerHost limits the connections to Nexus, 0 does not. MaxIdleConnsPerHost are kept
+	// open for IdleConnTimeout, and KeepAlive is the interval of TCP keep-alive probes.
+	MaxConnsPerHost     int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	KeepAlive           time.Duration
+}
+
+// NewClient returns an HTTP client of the options, for SetClient.
+func NewClient(options ClientOptions) *http.Client {
+	proxy := options.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	dialer := &net.Dialer{
+		Timeout:   options.ConnectTimeout,
+		KeepAlive: options.KeepAlive,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       options.TLS,
+			TLSHandshakeTimeout:   options.ConnectTimeout,
+			ResponseHeaderTimeout: options.ResponseTimeout,
+			ExpectContinueTimeout: time.Second,
+			ForceAttemptHTTP2:     true,
+			MaxConnsPerHost:       options.MaxConnsPerHost,
+			MaxIdleConns:          max(options.MaxIdleConnsPerHost, 100),
+			MaxIdleConnsPerHost:   options.MaxIdleConnsPerHost,
+			IdleConnTimeout:       options.IdleConnTimeout,
+		},
+	}
+}
+
+// SetClient sets the HTTP client searches, downloads and uploads are sent with, the default
+// client of net/http by default.
+func (n *CacheService) SetClient(client *http.Client) {
+	n.client = client
+}
+
+// SetRequestTimeout bounds the whole of searches, lookups of references and existence checks,
+// from sending the request to reading the response. Archives are streamed for as long as they
+// take. Requests are not bounded when it is 0.
+func (n *CacheService) SetRequestTimeout(timeout time.Duration) {
+	n.timeout = timeout
+}
+
+// withTimeout bounds a request by the request timeout, its response must be read before cancel
+// is called.
+func (n *CacheService) withTimeout(req *http.Request) (*http.Request, context.CancelFunc) {
+	if n.timeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), n.timeout)
+	return req.WithContext(ctx), cancel
+}
@@ -0,0 +1,694 @@
+package nexus_test
+
+import (
+	"act-nexus-cache/match/matchtest"
+	"act-nexus-cache/nexus"
+	"act-nexus-cache/nexus/nexustest"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	contractRepository = "gh-action-cache"
+	contractPrefix     = "act-nexus-cache"
+	contractNamespace  = "acme/app"
+)
+
+// contract is the fake a check runs against, with a CacheService pointed at it.
+type contract struct {
+	server  *nexustest.Server
+	service *nexus.CacheService
+	dir     string
+}
+
+// checks are the behaviors every CacheService must show against Nexus.
+var checks = []struct {
+	name string
+	run  func(c *contract) error
+}{
+	{"a cache is found by its key and version", checkExactKey},
+	{"restore keys match by prefix within the version, newest first", checkRestoreKeys},
+	{"lookups resolve like the local tier", checkMatchCases},
+	{"searches follow continuation tokens", checkPaging},
+	{"lookups stay within their repository and ref", checkIsolation},
+	{"only the sidecar of the cache picked is read", checkSidecarReads},
+	{"keys are never overwritten", checkImmutable},
+	{"keys of any characters round trip", checkUnsafeKeys},
+	{"keys and versions with dashes do not collide", checkDashes},
+	{"caches of older uploads joined by a dash are found", checkLegacyNames},
+	{"archives are uploaded whole unless chunking is enabled", checkChunkingOptIn},
+	{"blobs stored in parts are recognized", checkPartsShared},
+	{"ranges are served from blobs, chunks and parts", checkRanges},
+	{"fetches read the reference once and retry ranges cut short", checkFetchRetries},
+	{"quarantined caches are skipped by every instance and replaced", checkQuarantine},
+	{"server errors are returned", checkServerErrors},
+	{"slow lookups time out", checkRequestTimeout},
+	{"the status of Nexus is probed", checkStatus},
+	{"credentials are sent", checkCredentials},
+	{"credentials come from files, helpers and tokens", checkCredentialSources},
+	{"reads may be anonymous while uploads are authorized", checkAnonymousRead},
+}
+
+// TestContract runs the contract suite of CacheService, each check against a fresh fake.
+func TestContract(t *testing.T) {
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			server := nexustest.NewServer(contractRepository)
+			defer server.Close()
+			c := &contract{
+				server:  server,
+				service: nexus.NewCacheService(server.StoreEndpoint(contractPrefix)),
+				dir:     t.TempDir(),
+			}
+			if err := check.run(c); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// put stores content as a cache of the contract namespace without a ref.
+func (c *contract) put(key string, version string, content []byte) error {
+	file, err := os.CreateTemp(c.dir, "archive-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.Write(content); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	return c.service.PutCache(contractNamespace, "", key, version, file.Name(), hex.EncodeToString(sum[:]))
+}
+
+// find looks up the keys in the contract namespace, failing on a miss.
+func (c *contract) find(keys []string, version string) (*nexus.Cache, error) {
+	cache, err := c.service.FindCache(contractNamespace, nil, keys, version)
+	if err != nil {
+		return nil, err
+	}
+	if cache == nil {
+		return nil, fmt.Errorf("%q %q: not found", keys, version)
+	}
+	return cache, nil
+}
+
+// read opens the archive of a cache with a range and returns the status and the body.
+func (c *contract) read(cache *nexus.Cache, byteRange string) (int, []byte, error) {
+	object, err := c.service.Open(cache.Path, byteRange)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer object.Body.Close()
+	content, err := io.ReadAll(object.Body)
+	return object.StatusCode, content, err
+}
+
+// expectKey checks that the keys resolve to a cache of the wanted key and content.
+func (c *contract) expectKey(keys []string, version string, key string, content []byte) error {
+	cache, err := c.find(keys, version)
+	if err != nil {
+		return err
+	}
+	if cache.CacheKey != key {
+		return fmt.Errorf("%q %q: found %q, want %q", keys, version, cache.CacheKey, key)
+	}
+	_, got, err := c.read(cache, "")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, content) {
+		return fmt.Errorf("%q: content differs", key)
+	}
+	return nil
+}
+
+func randomContent(size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	return content
+}
+
+func checkExactKey(c *contract) error {
+	if err := c.put("linux-node", "v1", []byte("node")); err != nil {
+		return err
+	}
+	if err := c.put("linux-node-modules", "v1", []byte("modules")); err != nil {
+		return err
+	}
+	if err := c.expectKey([]string{"linux-node"}, "v1", "linux-node", []byte("node")); err != nil {
+		return err
+	}
+	if cache, err := c.service.FindCache(contractNamespace, nil, []string{"linux-node"}, "v2"); err != nil || cache != nil {
+		return fmt.Errorf("other version: found %v, %v", cache, err)
+	}
+	return nil
+}
+
+func checkRestoreKeys(c *contract) error {
+	for _, cache := range []struct{ key, version, content string }{
+		{"linux-a", "v-1", "a"},
+		{"linux-b", "v-1", "b"},
+		{"linux-c", "v-2", "c"},
+	} {
+		if err := c.put(cache.key, cache.version, []byte(cache.content)); err != nil {
+			return err
+		}
+		// creation times are recorded in the metadata, keep them apart
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.expectKey([]string{"linux-x", "linux-"}, "v-1", "linux-b", []byte("b")); err != nil {
+		return err
+	}
+	if err := c.expectKey([]string{"linux-a", "linux-"}, "v-1", "linux-a", []byte("a")); err != nil {
+		return err
+	}
+	return c.expectKey([]string{"linux-"}, "v-2", "linux-c", []byte("c"))
+}
+
+func checkMatchCases(c *contract) error {
+	for i, tc := range matchtest.Cases {
+		namespace := fmt.Sprintf("acme/case-%d", i)
+		for _, cache := range tc.Caches {
+			file := c.dir + "/archive"
+			if err := os.WriteFile(file, []byte(cache.Key), 0o600); err != nil {
+				return err
+			}
+			sum := sha256.Sum256([]byte(cache.Key))
+			if err := c.service.PutCache(namespace, "", cache.Key, cache.Version, file, hex.EncodeToString(sum[:])); err != nil {
+				return err
+			}
+			// creation times are recorded in milliseconds, keep them apart
+			time.Sleep(10 * time.Millisecond)
+		}
+		cache, err := c.service.FindCache(namespace, nil, tc.Keys, tc.Version)
+		if err != nil {
+			return fmt.Errorf("%s: %w", tc.Name, err)
+		}
+		got := ""
+		if cache != nil {
+			got = cache.CacheKey
+		}
+		if got != tc.Want {
+			return fmt.Errorf("%s: found %q, want %q", tc.Name, got, tc.Want)
+		}
+	}
+	return nil
+}
+
+func checkPaging(c *contract) error {
+	c.server.SetPageSize(2)
+	for i := 1; i <= 5; i++ {
+		if err := c.put(fmt.Sprintf("paged-%d", i), "v1", []byte{byte(i)}); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the newest cache is on the last page
+	return c.expectKey([]string{"paged-"}, "v1", "paged-5", []byte{5})
+}
+
+func checkIsolation(c *contract) error {
+	file := c.dir + "/archive"
+	if err := os.WriteFile(file, []byte("secret"), 0o600); err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte("secret"))
+	if err := c.service.PutCache("org/secret", "", "rust-deps", "v1", file, hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+	if err := c.service.PutCache("", "refs/heads/feature", "rust-deps", "v1", file, hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+	// the caches of repositories and refs are stored below the shared namespace
+	for _, key := range []string{"r", "re", "repos", "ref", "refs"} {
+		if cache, err := c.service.FindCache("", nil, []string{key}, "v1"); err != nil || cache != nil {
+			return fmt.Errorf("shared namespace %q: found %v, %v", key, cache, err)
+		}
+	}
+	if cache, err := c.service.FindCache("org/secret", nil, []string{"r"}, "v1"); err != nil || cache == nil {
+		return fmt.Errorf("own namespace: found %v, %v", cache, err)
+	}
+	return nil
+}
+
+func checkSidecarReads(c *contract) error {
+	for i := 1; i <= 5; i++ {
+		if err := c.put(fmt.Sprintf("broad-%d", i), "v1", []byte{byte(i)}); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	before := len(c.server.Requests())
+	if err := c.expectKey([]string{"broad-"}, "v1", "broad-5", []byte{5}); err != nil {
+		return err
+	}
+	reads := 0
+	for _, request := range c.server.Requests()[before:] {
+		if strings.HasPrefix(request, http.MethodGet+" ") && strings.HasSuffix(request, ".json") {
+			reads++
+		}
+	}
+	if reads != 1 {
+		return fmt.Errorf("%d sidecars read, want 1", reads)
+	}
+	return nil
+}
+
+func checkImmutable(c *contract) error {
+	if err := c.put("immutable", "v1", []byte("first")); err != nil {
+		return err
+	}
+	if err := c.put("immutable", "v1", []byte("second")); !errors.Is(err, nexus.ErrCacheExists) {
+		return fmt.Errorf("second put: %v, want %v", err, nexus.ErrCacheExists)
+	}
+	return c.expectKey([]string{"immutable"}, "v1", "immutable", []byte("first"))
+}
+
+func checkUnsafeKeys(c *contract) error {
+	keys := []string{"a/b c", "star*", "what?", "~tilde", "..", "é/🙂", "percent%2F"}
+	for i, key := range keys {
+		if err := c.put(key, "v 1/x", []byte(key)); err != nil {
+			return err
+		}
+		if err := c.expectKey([]string{key}, "v 1/x", key, []byte(key)); err != nil {
+			return err
+		}
+		if i == 0 {
+			// a prefix up to a slash matches, like any other prefix
+			if err := c.expectKey([]string{"a/"}, "v 1/x", key, []byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+	namespace := contractPrefix + "/repos/" + contractNamespace + "/"
+	for _, asset := range c.server.Assets() {
+		name := strings.TrimPrefix(asset, namespace)
+		if !strings.HasPrefix(name, "blobs/") && strings.Contains(name, "/") {
+			return fmt.Errorf("asset %s is not directly below the namespace", asset)
+		}
+	}
+	// wildcards of keys are literal
+	if cache, err := c.service.FindCache(contractNamespace, nil, []string{"st*"}, "v 1/x"); err != nil || cache != nil {
+		return fmt.Errorf("wildcard key: found %v, %v", cache, err)
+	}
+	return nil
+}
+
+func checkDashes(c *contract) error {
+	if err := c.put("a-b", "c", []byte("first")); err != nil {
+		return err
+	}
+	if err := c.put("a", "b-c", []byte("second")); err != nil {
+		return err
+	}
+	if err := c.expectKey([]string{"a-b"}, "c", "a-b", []byte("first")); err != nil {
+		return err
+	}
+	return c.expectKey([]string{"a"}, "b-c", "a", []byte("second"))
+}
+
+func checkLegacyNames(c *contract) error {
+	// uploaded in place and named <key>-<version>, with and without a sidecar
+	prefix := "/repository/" + contractRepository + "/" + contractPrefix + "/repos/" + contractNamespace + "/"
+	for path, content := range map[string]string{
+		"sidecar-v1":      "sidecar",
+		"sidecar-v1.json": `{"key": "sidecar", "version": "v1", "size": 7}`,
+		"bare-v1":         "bare",
+	} {
+		req, err := http.NewRequest(http.MethodPut, c.server.URL+prefix+path, strings.NewReader(content))
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("upload %s: %d", path, resp.StatusCode)
+		}
+	}
+	before := len(c.server.Requests())
+	if err := c.expectKey([]string{"sidecar"}, "v1", "sidecar", []byte("sidecar")); err != nil {
+		return err
+	}
+	for _, request := range c.server.Requests()[before:] {
+		if strings.HasSuffix(request, ".json") {
+			return fmt.Errorf("sidecar read: %s", request)
+		}
+	}
+	return c.expectKey([]string{"bare"}, "v1", "bare", []byte("bare"))
+}
+
+func checkChunkingOptIn(c *contract) error {
+	content := randomContent(64 << 10)
+	if err := c.put("whole", "v1", content); err != nil {
+		return err
+	}
+	for _, path := range c.server.Assets() {
+		if strings.Contains(path, "/chunks/") {
+			return fmt.Errorf("chunk %s uploaded by default", path)
+		}
+	}
+	c.service.SetChunkSize(4 << 10)
+	if err := c.put("chunked", "v1", append([]byte("chunked"), content...)); err != nil {
+		return err
+	}
+	for _, path := range c.server.Assets() {
+		if strings.Contains(path, "/chunks/") {
+			return c.expectKey([]string{"chunked"}, "v1", "chunked", append([]byte("chunked"), content...))
+		}
+	}
+	return fmt.Errorf("no chunks uploaded with chunking enabled")
+}
+
+func checkPartsShared(c *contract) error {
+	content := randomContent(64 << 10)
+	c.service.SetPartSize(10 << 10)
+	if err := c.put("first", "v1", content); err != nil {
+		return err
+	}
+	before := len(c.server.Requests())
+	if err := c.put("second", "v1", content); err != nil {
+		return err
+	}
+	for _, request := range c.server.Requests()[before:] {
+		// the stored parts are recognized without looking at them one by one
+		if strings.Contains(request, ".part0") || strings.HasPrefix(request, http.MethodPut+" ") && strings.Contains(request, "/blobs/") {
+			return fmt.Errorf("blob stored again: %s", request)
+		}
+	}
+	return c.expectKey([]string{"second"}, "v1", "second", content)
+}
+
+func checkRanges(c *contract) error {
+	content := randomContent(64 << 10)
+	layouts := []struct {
+		key       string
+		chunkSize int
+		partSize  int64
+	}{
+		{"blob", 0, 0},
+		{"chunks", 4 << 10, 0},
+		{"parts", 0, 10 << 10},
+	}
+	for _, layout := range layouts {
+		c.service.SetChunkSize(layout.chunkSize)
+		c.service.SetPartSize(layout.partSize)
+		// the content differs per layout, so the blob of one is not reused by another
+		content := append([]byte(layout.key), content...)
+		if err := c.put(layout.key, "v1", content); err != nil {
+			return err
+		}
+		cache, err := c.find([]string{layout.key}, "v1")
+		if err != nil {
+			return err
+		}
+		size := int64(len(content))
+		for _, r := range []struct {
+			header     string
+			start, end int64
+		}{
+			{"bytes=0-0", 0, 0},
+			{"bytes=1000-30000", 1000, 30000},
+			{"bytes=20000-", 20000, size - 1},
+			{"bytes=-100", size - 100, size - 1},
+		} {
+			status, got, err := c.read(cache, r.header)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", layout.key, r.header, err)
+			}
+			if status != http.StatusPartialContent || !bytes.Equal(got, content[r.start:r.end+1]) {
+				return fmt.Errorf("%s %s: status %d with %d bytes", layout.key, r.header, status, len(got))
+			}
+		}
+		if _, got, err := c.read(cache, ""); err != nil || !bytes.Equal(got, content) {
+			return fmt.Errorf("%s: whole archive differs, %v", layout.key, err)
+		}
+	}
+	return nil
+}
+
+func checkFetchRetries(c *contract) error {
+	content := randomContent(5 << 20)
+	if err := c.put("fetched", "v1", content); err != nil {
+		return err
+	}
+	cache, err := c.find([]string{"fetched"}, "v1")
+	if err != nil {
+		return err
+	}
+	c.server.SetLatency(5 * time.Millisecond)
+	c.server.Inject(nexustest.Fault{
+		Method:   http.MethodGet,
+		Prefix:   "/repository/" + contractRepository + "/" + contractPrefix + "/repos/" + contractNamespace + "/blobs/",
+		Truncate: true,
+		Times:    2,
+	})
+
+	file, err := os.CreateTemp(c.dir, "fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	before := len(c.server.Requests())
+	result, err := c.service.Fetch(cache.Path, file, 4)
+	if err != nil {
+		return err
+	}
+	// the ranges and their retries are requested from the blob the reference points at
+	reads := 0
+	for _, request := range c.server.Requests()[before:] {
+		if strings.HasSuffix(request, ".ref") {
+			reads++
+		}
+	}
+	if reads != 1 {
+		return fmt.Errorf("reference read %d times, want once", reads)
+	}
+	got, err := os.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, content) {
+		return errors.New("fetched archive differs")
+	}
+	if result.Retries != 2 {
+		return fmt.Errorf("%d retries, want 2", result.Retries)
+	}
+	return nil
+}
+
+func checkQuarantine(c *contract) error {
+	if err := c.put("quarantined", "v1", []byte("sound")); err != nil {
+		return err
+	}
+	for _, path := range c.server.Assets() {
+		if strings.Contains(path, "/blobs/sha256/") {
+			c.server.Corrupt(path, 0)
+		}
+	}
+	cache, err := c.find([]string{"quarantined"}, "v1")
+	if err != nil {
+		return err
+	}
+	if err := c.service.Quarantine(cache.Path); err != nil {
+		return err
+	}
+	// the quarantine outlives the instance which found the asset corrupt
+	other := &contract{
+		server:  c.server,
+		service: nexus.NewCacheService(c.server.StoreEndpoint(contractPrefix)),
+		dir:     c.dir,
+	}
+	for _, instance := range []*contract{c, other} {
+		if cache, err := instance.service.FindCache(contractNamespace, nil, []string{"quarantined"}, "v1"); err != nil || cache != nil {
+			return fmt.Errorf("quarantined: found %v, %v", cache, err)
+		}
+	}
+
+	// a sound archive replaces it, blob included, and lifts the quarantine
+	if err := other.put("quarantined", "v1", []byte("sound")); err != nil {
+		return err
+	}
+	if err := c.expectKey([]string{"quarantined"}, "v1", "quarantined", []byte("sound")); err != nil {
+		return err
+	}
+	for _, path := range c.server.Assets() {
+		if strings.HasSuffix(path, ".quarantined") {
+			return fmt.Errorf("marker %s left after the replacement", path)
+		}
+	}
+	if err := c.put("quarantined", "v1", []byte("again")); !errors.Is(err, nexus.ErrCacheExists) {
+		return fmt.Errorf("put after the replacement: %v, want %v", err, nexus.ErrCacheExists)
+	}
+
+	// without a marker, the asset is only hidden from the instance which found it corrupt
+	c.server.Inject(nexustest.Fault{Method: http.MethodPut, Status: http.StatusForbidden, Times: 1})
+	if err := c.service.Quarantine(cache.Path); err == nil {
+		return errors.New("marker uploaded despite the fault")
+	}
+	if cache, err := c.service.FindCache(contractNamespace, nil, []string{"quarantined"}, "v1"); err != nil || cache != nil {
+		return fmt.Errorf("quarantined without a marker: found %v, %v", cache, err)
+	}
+	return other.expectKey([]string{"quarantined"}, "v1", "quarantined", []byte("sound"))
+}
+
+func checkServerErrors(c *contract) error {
+	if err := c.put("errors", "v1", []byte("errors")); err != nil {
+		return err
+	}
+	c.server.Inject(nexustest.Fault{Prefix: "/service/rest/v1/search/", Status: http.StatusInternalServerError, Times: 1})
+	var statusErr *nexus.StatusError
+	if _, err := c.service.FindCache(contractNamespace, nil, []string{"errors"}, "v1"); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		return fmt.Errorf("search: %v, want a 500", err)
+	}
+
+	c.server.Inject(nexustest.Fault{Method: http.MethodPut, Status: http.StatusForbidden, Times: -1})
+	if err := c.put("denied", "v1", []byte("denied")); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		return fmt.Errorf("put: %v, want a 403", err)
+	}
+	return nil
+}
+
+func checkCredentials(c *contract) error {
+	c.server.SetCredentials(os.Getenv("NEXUS_USERNAME"), os.Getenv("NEXUS_SECRET"), false)
+	if err := c.put("authenticated", "v1", []byte("authenticated")); err != nil {
+		return err
+	}
+	if err := c.expectKey([]string{"authenticated"}, "v1", "authenticated", []byte("authenticated")); err != nil {
+		return err
+	}
+
+	c.server.SetCredentials(os.Getenv("NEXUS_USERNAME"), os.Getenv("NEXUS_SECRET")+"-rotated", false)
+	var statusErr *nexus.StatusError
+	if _, err := c.service.FindCache(contractNamespace, nil, []string{"authenticated"}, "v1"); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("wrong credentials: %v, want a 401", err)
+	}
+	return nil
+}
+
+func checkCredentialSources(c *contract) error {
+	file := c.dir + "/credentials"
+	if err := os.WriteFile(file, []byte("deploy:first\n"), 0o600); err != nil {
+		return err
+	}
+	fromFile, err := nexus.CredentialsFile(file)
+	if err != nil {
+		return err
+	}
+	c.service.SetCredentials(fromFile)
+	c.server.SetCredentials("deploy", "first", false)
+	if err := c.put("file", "v1", []byte("file")); err != nil {
+		return err
+	}
+	// rotated credentials are read again
+	if err := os.WriteFile(file, []byte("deploy:second\n"), 0o600); err != nil {
+		return err
+	}
+	if err := os.Chtimes(file, time.Now(), time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	c.server.SetCredentials("deploy", "second", false)
+	if err := c.expectKey([]string{"file"}, "v1", "file", []byte("file")); err != nil {
+		return fmt.Errorf("rotated file: %w", err)
+	}
+
+	netrc := c.dir + "/netrc"
+	host := strings.TrimPrefix(c.server.URL, "http://")
+	host = host[:strings.LastIndex(host, ":")]
+	content := "machine other login nobody password none\nmachine " + host + "\n  login netrc\n  password secret\ndefault login anonymous password none\n"
+	if err := os.WriteFile(netrc, []byte(content), 0o600); err != nil {
+		return err
+	}
+	fromNetrc, err := nexus.Netrc(netrc, host)
+	if err != nil {
+		return err
+	}
+	c.service.SetCredentials(fromNetrc)
+	c.server.SetCredentials("netrc", "secret", false)
+	if err := c.expectKey([]string{"file"}, "v1", "file", []byte("file")); err != nil {
+		return fmt.Errorf("netrc: %w", err)
+	}
+
+	helper := c.dir + "/helper"
+	script := "#!/bin/sh\n[ \"$1\" = get ] || exit 1\ncat > /dev/null\necho username=helper\necho password=printed\n"
+	if err := os.WriteFile(helper, []byte(script), 0o700); err != nil {
+		return err
+	}
+	c.service.SetCredentials(nexus.CredentialHelper(helper, "http", host))
+	c.server.SetCredentials("helper", "printed", false)
+	if err := c.expectKey([]string{"file"}, "v1", "file", []byte("file")); err != nil {
+		return fmt.Errorf("helper: %w", err)
+	}
+
+	token, err := nexus.UserToken("nameCode:passCode")
+	if err != nil {
+		return err
+	}
+	c.service.SetCredentials(token)
+	c.server.SetCredentials("nameCode", "passCode", false)
+	if err := c.expectKey([]string{"file"}, "v1", "file", []byte("file")); err != nil {
+		return fmt.Errorf("user token: %w", err)
+	}
+	return nil
+}
+
+func checkAnonymousRead(c *contract) error {
+	c.server.SetCredentials("deploy", "secret", true)
+	c.service.SetCredentials(nexus.AnonymousRead(nexus.BasicAuth("deploy", "secret")))
+	if err := c.put("anonymous", "v1", []byte("anonymous")); err != nil {
+		return err
+	}
+	if err := c.expectKey([]string{"anonymous"}, "v1", "anonymous", []byte("anonymous")); err != nil {
+		return err
+	}
+
+	c.service.SetCredentials(nexus.AnonymousRead(nil))
+	if err := c.put("denied", "v1", []byte("denied")); err == nil {
+		return errors.New("upload without credentials succeeded")
+	}
+	return nil
+}
+
+func checkRequestTimeout(c *contract) error {
+	if err := c.put("slow", "v1", []byte("slow")); err != nil {
+		return err
+	}
+	c.server.SetLatency(time.Second)
+	c.service.SetRequestTimeout(100 * time.Millisecond)
+	started := time.Now()
+	if _, err := c.service.FindCache(contractNamespace, nil, []string{"slow"}, "v1"); !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("lookup: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		return fmt.Errorf("lookup took %v", elapsed)
+	}
+	return nil
+}
+
+func checkStatus(c *contract) error {
+	if err := c.service.Status(); err != nil {
+		return fmt.Errorf("status: %v", err)
+	}
+	c.server.Inject(nexustest.Fault{Prefix: "/service/rest/v1/status", Status: http.StatusServiceUnavailable, Times: 1})
+	var statusErr *nexus.StatusError
+	if err := c.service.Status(); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		return fmt.Errorf("status: %v, want a 503", err)
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package nexus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// helperTTL is how long the credentials printed by a credential helper are used before it is run again.
+	helperTTL = time.Minute
+	// helperTimeout is how long a credential helper may run before it is killed.
+	helperTimeout = 30 * time.Second
+)
+
+// Credentials authorize the requests of a CacheService.
+type Credentials interface {
+	// Authorize sets the authorization of a request, write is set for uploads.
+	Authorize(req *http.Request, write bool) error
+}
+
+// SetCredentials sets how requests are authorized, by default with NEXUS_USERNAME and NEXUS_SECRET.
+func (n *CacheService) SetCredentials(credentials Credentials) {
+	n.credentials = credentials
+}
+
+// authorize authorizes a request with the credentials of the service.
+func (n *CacheService) authorize(req *http.Request, write bool) error {
+	if err := n.credentials.Authorize(req, write); err != nil {
+		return fmt.Errorf("credentials of %s: %w", n.endPoint, err)
+	}
+	return nil
+}
+
+// envCredentials authorize with NEXUS_USERNAME and NEXUS_SECRET as they are at the time of the request.
+type envCredentials struct{}
+
+func (envCredentials) Authorize(req *http.Request, write bool) error {
+	req.SetBasicAuth(os.Getenv("NEXUS_USERNAME"), os.Getenv("NEXUS_SECRET"))
+	return nil
+}
+
+type basicAuth struct {
+	username string
+	secret   string
+}
+
+// BasicAuth returns credentials of a fixed username and secret.
+func BasicAuth(username string, secret string) Credentials {
+	return &basicAuth{username: username, secret: secret}
+}
+
+// UserToken returns the credentials of a Nexus user token, given as its name code and pass code
+// separated by a colon.
+func UserToken(token string) (Credentials, error) {
+	nameCode, passCode, ok := strings.Cut(strings.TrimSpace(token), ":")
+	if !ok || nameCode == "" || passCode == "" {
+		return nil, errors.New("user token must be <name code>:<pass code>")
+	}
+	return BasicAuth(nameCode, passCode), nil
+}
+
+func (b *basicAuth) Authorize(req *http.Request, write bool) error {
+	req.SetBasicAuth(b.username, b.secret)
+	return nil
+}
+
+// fileCredentials reads the credentials from a file, reloading them whenever the file changes so
+// that rotated credentials are picked up without a restart.
+type fileCredentials struct {
+	path  string
+	parse func(content []byte) (*basicAuth, error)
+
+	mu          sync.Mutex
+	credentials *basicAuth
+	modTime     time.Time
+}
+
+// CredentialsFile returns the credentials of a file holding <username>:<secret>, like a user token.
+func CredentialsFile(path string) (Credentials, error) {
+	f := &fileCredentials{path: path, parse: parseCredentials}
+	// fail early on a broken file instead of on the first request
+	if _, err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Netrc returns the credentials of the entry of a netrc file for a host, or of its default entry.
+func Netrc(path string, host string) (Credentials, error) {
+	f := &fileCredentials{
+		path:  path,
+		parse: func(content []byte) (*basicAuth, error) { return parseNetrc(content, host) },
+	}
+	if _, err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileCredentials) Authorize(req *http.Request, write bool) error {
+	credentials, err := f.load()
+	if err != nil {
+		return err
+	}
+	return credentials.Authorize(req, write)
+}
+
+func (f *fileCredentials) load() (*basicAuth, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.credentials != nil && info.ModTime().Equal(f.modTime) {
+		return f.credentials, nil
+	}
+
+	content, err := os.ReadFile(f.path)
+	if err == nil {
+		var credentials *basicAuth
+		if credentials, err = f.parse(content); err == nil {
+			f.credentials = credentials
+			f.modTime = info.ModTime()
+			return credentials, nil
+		}
+	}
+	if f.credentials != nil {
+		// the file is most likely being replaced, keep using the previous credentials
+		return f.credentials, nil
+	}
+	return nil, fmt.Errorf("read credentials %s: %w", f.path, err)
+}
+
+func parseCredentials(content []byte) (*basicAuth, error) {
+	username, secret, ok := strings.Cut(strings.TrimSpace(string(content)), ":")
+	if !ok || username == "" {
+		return nil, errors.New("expected <username>:<secret>")
+	}
+	return &basicAuth{username: username, secret: secret}, nil
+}
+
+// parseNetrc returns the login and password of the machine entry of a host, or of the default entry.
+func parseNetrc(content []byte, host string) (*basicAuth, error) {
+	var found, fallback *basicAuth
+	var entry *basicAuth
+	fields := strings.Fields(string(content))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			entry = nil
+			if i+1 < len(fields) && fields[i+1] == host && found == nil {
+				found = &basicAuth{}
+				entry = found
+			}
+			i++
+		case "default":
+			entry = nil
+			if fallback == nil {
+				fallback = &basicAuth{}
+				entry = fallback
+			}
+		case "login", "password", "account":
+			if i+1 < len(fields) && entry != nil && fields[i] == "login" {
+				entry.username = fields[i+1]
+			} else if i+1 < len(fields) && entry != nil && fields[i] == "password" {
+				entry.secret = fields[i+1]
+			}
+			i++
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, fmt.Errorf("no entry for %s", host)
+}
+
+// credentialHelper runs a command speaking the protocol of git credential helpers: it is run with
+// the argument get, reads the protocol and host on stdin and prints username and password.
+type credentialHelper struct {
+	command  string
+	protocol string
+	host     string
+	timeout  time.Duration
+
+	mu          sync.Mutex
+	credentials *basicAuth
+	expires     time.Time
+	// running is closed once the run under way completes, err is the error it failed with
+	running chan struct{}
+	err     error
+}
+
+// CredentialHelper returns the credentials printed by a helper command, which is run by the shell
+// and run again once they are older than a minute. A helper which runs longer than 30 seconds is
+// killed.
+func CredentialHelper(command string, protocol string, host string) Credentials {
+	return &credentialHelper{command: command, protocol: protocol, host: host, timeout: helperTimeout}
+}
+
+func (c *credentialHelper) Authorize(req *http.Request, write bool) error {
+	credentials, err := c.load()
+	if err != nil {
+		return err
+	}
+	return credentials.Authorize(req, write)
+}
+
+// load returns the credentials printed by the helper, running it when they expired. Requests made
+// while it runs use the expired credentials, or wait for it when there are none yet, so that the
+// helper is run once at a time and without holding the lock.
+func (c *credentialHelper) load() (*basicAuth, error) {
+	c.mu.Lock()
+	if c.credentials != nil && (c.running != nil || time.Now().Before(c.expires)) {
+		defer c.mu.Unlock()
+		return c.credentials, nil
+	}
+	if running := c.running; running != nil {
+		c.mu.Unlock()
+		<-running
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.credentials == nil {
+			return nil, c.err
+		}
+		return c.credentials, nil
+	}
+	running := make(chan struct{})
+	c.running = running
+	c.mu.Unlock()
+
+	credentials, err := c.run()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.credentials = credentials
+		c.expires = time.Now().Add(helperTTL)
+	}
+	c.err = err
+	c.running = nil
+	close(running)
+	return credentials, err
+}
+
+func (c *credentialHelper) run() (*basicAuth, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.command+" get")
+	// the children of the shell may hold on to its output once it is killed
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=%s\nhost=%s\n\n", c.protocol, c.host))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("credential helper: no answer within %v", c.timeout)
+	} else if err != nil {
+		return nil, fmt.Errorf("credential helper: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	credentials := &basicAuth{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "username":
+			credentials.username = value
+		case "password":
+			credentials.secret = value
+		}
+	}
+	if credentials.username == "" && credentials.secret == "" {
+		return nil, errors.New("credential helper printed no username and password")
+	}
+	return credentials, nil
+}
+
+// anonymousRead leaves reads unauthorized, only uploads are authorized.
+type anonymousRead struct {
+	write Credentials
+}
+
+// AnonymousRead returns credentials which only authorize uploads, for repositories which allow
+// anonymous reads. write may be nil when nothing is uploaded.
+func AnonymousRead(write Credentials) Credentials {
+	return &anonymousRead{write: write}
+}
+
+func (a *anonymousRead) Authorize(req *http.Request, write bool) error {
+	if !write {
+		return nil
+	}
+	if a.write == nil {
+		return errors.New("uploads need credentials")
+	}
+	return a.write.Authorize(req, write)
+}
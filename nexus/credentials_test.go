@@ -0,0 +1,63 @@
+package nexus
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeHelper writes a credential helper script which logs its runs to a file.
+func writeHelper(t *testing.T, body string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	helper, runs := filepath.Join(dir, "helper"), filepath.Join(dir, "runs")
+	script := "#!/bin/sh\necho run >> " + runs + "\ncat > /dev/null\n" + body
+	if err := os.WriteFile(helper, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return helper, runs
+}
+
+func TestCredentialHelperRunsOnce(t *testing.T) {
+	helper, runs := writeHelper(t, "sleep 0.2\necho username=helper\necho password=printed\n")
+	credentials := CredentialHelper(helper, "http", "nexus")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, "http://nexus", nil)
+			if err := credentials.Authorize(req, false); err != nil {
+				t.Error(err)
+				return
+			}
+			if username, password, _ := req.BasicAuth(); username != "helper" || password != "printed" {
+				t.Errorf("authorized as %s:%s", username, password)
+			}
+		}()
+	}
+	wg.Wait()
+	if content, _ := os.ReadFile(runs); strings.Count(string(content), "run") != 1 {
+		t.Fatalf("helper run %d times, want once", strings.Count(string(content), "run"))
+	}
+}
+
+func TestCredentialHelperTimeout(t *testing.T) {
+	helper, _ := writeHelper(t, "sleep 10\n")
+	credentials := CredentialHelper(helper, "http", "nexus").(*credentialHelper)
+	credentials.timeout = 100 * time.Millisecond
+
+	started := time.Now()
+	req, _ := http.NewRequest(http.MethodGet, "http://nexus", nil)
+	if err := credentials.Authorize(req, false); err == nil {
+		t.Fatal("authorized by a helper which never answered")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("helper killed after %v", elapsed)
+	}
+}
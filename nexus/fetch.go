@@ -0,0 +1,173 @@
+package nexus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// fetchRetries is how many times a range is requested again after it failed, fetchBackoff how
+	// long the first retry waits, the wait doubles with every retry.
+	fetchRetries = 3
+	fetchBackoff = 100 * time.Millisecond
+	// fetchMinSegment and fetchMaxSegment bound the ranges an archive is fetched in.
+	fetchMinSegment = 1 << 20
+	fetchMaxSegment = 64 << 20
+)
+
+// FetchResult describes an archive fetched by Fetch.
+type FetchResult struct {
+	Size int64
+	// Sha256 is the hex digest of the archive, empty when unknown.
+	Sha256  string
+	Elapsed time.Duration
+	// Retries is how many ranges were requested again after they failed.
+	Retries int
+}
+
+// Throughput returns the bytes fetched per second.
+func (r *FetchResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Size) / r.Elapsed.Seconds()
+}
+
+// resolve returns the Reference of the archive of a cache found by FindCache, an asset uploaded in
+// place is described by a Reference to itself without a digest.
+func (n *CacheService) resolve(path string) (*Reference, error) {
+	if strings.HasSuffix(path, referenceSuffix) {
+		reference := &Reference{}
+		if err := n.fetchJSON(n.assetURL(path), reference); err != nil {
+			return nil, fmt.Errorf("read reference %s: %w", path, err)
+		}
+		return reference, nil
+	}
+
+	req, err := http.NewRequest("HEAD", n.assetURL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.authorize(req, false); err != nil {
+		return nil, err
+	}
+	req, cancel := n.withTimeout(req)
+	defer cancel()
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Op: "stat " + path, StatusCode: resp.StatusCode}
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: no content length", path)
+	}
+	// only references record the digest
+	return &Reference{Blob: path, Size: size}, nil
+}
+
+// Fetch downloads the archive of a cache found by FindCache into the file, which is preallocated
+// to the size of the archive, with up to connections range requests in parallel. The reference is
+// read once, the ranges are requested from the blob or the parts it points at. A range which fails
+// is requested again from where it stopped after a backoff, up to fetchRetries times.
+func (n *CacheService) Fetch(path string, file *os.File, connections int) (*FetchResult, error) {
+	connections = max(connections, 1)
+	started := time.Now()
+	reference, err := n.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	size := reference.Size
+	if err := file.Truncate(size); err != nil {
+		return nil, err
+	}
+
+	segment := min(max((size+int64(connections)-1)/int64(connections), fetchMinSegment), fetchMaxSegment)
+	segments := make(chan int64)
+	go func() {
+		defer close(segments)
+		for offset := int64(0); offset < size; offset += segment {
+			segments <- offset
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		retries  atomic.Int64
+		failed   atomic.Bool
+		errOnce  sync.Once
+		fetchErr error
+	)
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range segments {
+				if failed.Load() {
+					continue
+				}
+				end := min(start+segment, size) - 1
+				if err := n.fetchRange(path, reference, file, start, end, &retries); err != nil {
+					failed.Store(true)
+					errOnce.Do(func() { fetchErr = err })
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+
+	return &FetchResult{
+		Size:    size,
+		Sha256:  reference.Sha256,
+		Elapsed: time.Since(started),
+		Retries: int(retries.Load()),
+	}, nil
+}
+
+// fetchRange downloads the bytes from start to end inclusive of the archive of the cache at path
+// into the file, resuming from the last byte written when the download fails.
+func (n *CacheService) fetchRange(path string, reference *Reference, file *os.File, start int64, end int64, retries *atomic.Int64) error {
+	for attempt := 0; ; attempt++ {
+		written, err := n.downloadRange(path, reference, file, start, end)
+		start += written
+		if err == nil && start > end {
+			return nil
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		var statusErr *StatusError
+		if attempt == fetchRetries || errors.As(err, &statusErr) && statusErr.StatusCode < 500 {
+			return fmt.Errorf("fetch %s bytes %d-%d: %w", path, start, end, err)
+		}
+		retries.Add(1)
+		time.Sleep(fetchBackoff << attempt)
+	}
+}
+
+func (n *CacheService) downloadRange(path string, reference *Reference, file *os.File, start int64, end int64) (int64, error) {
+	object, err := n.openReference(reference, fmt.Sprintf("bytes=%d-%d", start, end))
+	if err != nil {
+		return 0, err
+	}
+	defer object.Body.Close()
+	if object.StatusCode != http.StatusPartialContent {
+		return 0, &StatusError{Op: "fetch range of " + path, StatusCode: object.StatusCode}
+	}
+	return io.Copy(io.NewOffsetWriter(file, start), io.LimitReader(object.Body, end-start+1))
+}
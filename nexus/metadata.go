@@ -0,0 +1,58 @@
+package nexus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// metadataSuffix is appended to the path of a cache key for its Metadata sidecar.
+const metadataSuffix = ".json"
+
+// Metadata is stored next to every cache PutCache uploads. Lookups read the key and the version
+// of a cache from it rather than from the name of its asset, as both may contain dashes.
+type Metadata struct {
+	Key     string `json:"key"`
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	// Sha256 is the hex digest of the archive, empty when unknown.
+	Sha256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Creator is the host which uploaded the cache.
+	Creator string `json:"creator"`
+}
+
+// defaultCreator returns the creator recorded in the metadata of uploaded caches.
+func defaultCreator() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "act-nexus-cache"
+	}
+	return hostname
+}
+
+// SetCreator sets the creator recorded in the metadata of uploaded caches, the hostname by default.
+func (n *CacheService) SetCreator(creator string) {
+	n.creator = creator
+}
+
+// putMetadata uploads the metadata sidecar of a cache key. It is uploaded last, lookups only find
+// a cache once its archive is complete.
+func (n *CacheService) putMetadata(storeKey string, metadata *Metadata) error {
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return n.uploadFile(n.assetURL(storeKey+metadataSuffix), bytes.NewReader(content))
+}
+
+// readMetadata reads the metadata sidecar at a path.
+func (n *CacheService) readMetadata(path string) (*Metadata, error) {
+	metadata := &Metadata{}
+	if err := n.fetchJSON(n.assetURL(path), metadata); err != nil {
+		return nil, fmt.Errorf("read metadata %s: %w", path, err)
+	}
+	return metadata, nil
+}
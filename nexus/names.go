@@ -0,0 +1,89 @@
+package nexus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nameEscape starts an escaped byte in the name of an asset, it is followed by two upper case hex
+// digits. git does not allow it in ref names and it needs no escaping in URLs.
+const nameEscape = '~'
+
+// nameSeparator separates the encoded key and version in the name of an asset. encodeName never
+// emits it, as an escape is always followed by hex digits, so the first one in a name is the
+// separator and every key and version have a name of their own.
+const nameSeparator = "~~"
+
+// legacySeparator separated the key and version in the names of assets uploaded before
+// nameSeparator, a key ending with a dash cannot be told apart from a version starting with one.
+const legacySeparator = "-"
+
+// encodeName encodes a cache key or version into a single segment of an asset path, which is
+// also taken literally by the name parameter of a search. Bytes other than letters, digits, '.',
+// '_' and '-' are escaped one by one, so the encoding of a prefix of a key is a prefix of the
+// encoding of the key and prefix searches keep working. A leading dot is escaped too, so neither
+// "." nor ".." ever end up as a path segment.
+func encodeName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isNameByte(c) && !(i == 0 && c == '.') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%c%02X", nameEscape, c)
+	}
+	return b.String()
+}
+
+// decodeName reverses encodeName.
+func decodeName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c != nameEscape {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid asset name %q", s)
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid asset name %q", s)
+		}
+		b.WriteByte(byte(v))
+		i += 2
+	}
+	// every name has a single encoding, so no two assets decode to the same key
+	if encodeName(b.String()) != s {
+		return "", fmt.Errorf("invalid asset name %q", s)
+	}
+	return b.String(), nil
+}
+
+// assetName returns the name of the assets of a cache key and version below a store prefix.
+func assetName(key string, version string) string {
+	return encodeName(key) + nameSeparator + encodeName(version)
+}
+
+// parseAssetName reverses assetName.
+func parseAssetName(name string) (string, string, error) {
+	encodedKey, encodedVersion, ok := strings.Cut(name, nameSeparator)
+	if !ok {
+		return "", "", fmt.Errorf("invalid asset name %q", name)
+	}
+	key, err := decodeName(encodedKey)
+	if err != nil {
+		return "", "", err
+	}
+	version, err := decodeName(encodedVersion)
+	if err != nil {
+		return "", "", err
+	}
+	return key, version, nil
+}
+
+func isNameByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-'
+}
@@ -0,0 +1,69 @@
+package nexus
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// nameAlphabet is biased towards the bytes the encoding treats specially.
+var nameAlphabet = []string{"a", "Z", "0", ".", "_", "-", "~", "~~", "/", " ", "*", "?", "%", "2D", "7E", "é", "🙂", "\x00", "\xff"}
+
+func randomName(r *rand.Rand) string {
+	var b strings.Builder
+	for i := r.Intn(8); i > 0; i-- {
+		b.WriteString(nameAlphabet[r.Intn(len(nameAlphabet))])
+	}
+	return b.String()
+}
+
+func TestEncodeNameRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		s := randomName(r)
+		encoded := encodeName(s)
+		for j := 0; j < len(encoded); j++ {
+			if c := encoded[j]; !isNameByte(c) && c != nameEscape {
+				t.Fatalf("encodeName(%q) = %q holds %q", s, encoded, c)
+			}
+		}
+		if strings.HasPrefix(encoded, ".") || strings.Contains(encoded, nameSeparator) {
+			t.Fatalf("encodeName(%q) = %q", s, encoded)
+		}
+		if decoded, err := decodeName(encoded); err != nil || decoded != s {
+			t.Fatalf("decodeName(%q) = %q, %v, want %q", encoded, decoded, err, s)
+		}
+		for j := 0; j <= len(s); j++ {
+			if !strings.HasPrefix(encoded, encodeName(s[:j])) {
+				t.Fatalf("encodeName(%q) is not a prefix of encodeName(%q)", s[:j], s)
+			}
+		}
+	}
+}
+
+func TestAssetNameUnique(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	names := map[string][2]string{}
+	for i := 0; i < 10000; i++ {
+		key, version := randomName(r), randomName(r)
+		name := assetName(key, version)
+		if k, v, err := parseAssetName(name); err != nil || k != key || v != version {
+			t.Fatalf("parseAssetName(%q) = %q, %q, %v, want %q, %q", name, k, v, err, key, version)
+		}
+		if other, ok := names[name]; ok && other != [2]string{key, version} {
+			t.Fatalf("%q and %q are both named %q", other, [2]string{key, version}, name)
+		}
+		names[name] = [2]string{key, version}
+	}
+	if assetName("a-b", "c") == assetName("a", "b-c") {
+		t.Fatalf("key a-b of version c and key a of version b-c share a name")
+	}
+}
+
+func TestDecodeNameRejectsNonCanonical(t *testing.T) {
+	for _, name := range []string{"~", "~7", "~zz", "~61", ".x", "a/b", "~2d"} {
+		if decoded, err := decodeName(name); err == nil {
+			t.Errorf("decodeName(%q) = %q, want an error", name, decoded)
+		}
+	}
+}
@@ -1,31 +1,84 @@
 package nexus
 
 import (
+	"act-nexus-cache/match"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
-	"sort"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Cache struct {
 	ArchiveLocation string
 	CacheKey        string
+	// Path is the path of the asset in the repository, as accepted by Download.
+	Path string
 }
 
-type Search struct {
-	searchKey string
-	key       string
+// StatusError is returned when Nexus answers with an unexpected status.
+type StatusError struct {
+	Op         string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.Op, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+const (
+	// referenceSuffix is appended to the path of a cache key for the Reference to its blob.
+	referenceSuffix = ".ref"
+	// quarantineSuffix is appended to the path of an asset which failed verification for the
+	// marker hiding it from lookups.
+	quarantineSuffix = ".quarantined"
+
+	defaultPartSize = 1 << 30
+)
+
+// ErrCacheExists is returned by PutCache for a key which is already stored, keys are immutable.
+var ErrCacheExists = errors.New("cache already exists")
+
+// Reference is stored at the path of a cache key in place of the archive. It points at the blob
+// holding the archive, or lists the parts the archive is stored in. Blobs and chunks are named
+// after their sha256 so identical content is uploaded once.
+type Reference struct {
+	Blob   string `json:"blob,omitempty"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	Parts  []Part `json:"parts,omitempty"`
+}
+
+// Object is an archive opened for download.
+type Object struct {
+	*http.Response
+	// Sha256 is the hex digest of the archive, empty when unknown.
+	Sha256 string
 }
 
 type CacheService struct {
 	endPoint   string
 	repository string
 	prefix     string // prefix path will always had trailing slash
+	chunkSize  int
+	partSize   int64
+	creator    string
+
+	credentials Credentials
+	client      *http.Client
+	// timeout bounds the requests whose responses are read at once, see SetRequestTimeout.
+	timeout time.Duration
+
+	// quarantined holds the paths of assets which failed verification but could not be marked
+	// quarantined in the repository, lookups skip them like the assets with a marker.
+	quarantined sync.Map
 }
 
 func NewCacheService(fullPath string) *CacheService {
@@ -48,130 +101,393 @@ func NewCacheService(fullPath string) *CacheService {
 		endPoint:   endPoint,
 		repository: repository,
 		prefix:     prefix,
+		partSize:   defaultPartSize,
+		creator:    defaultCreator(),
+
+		credentials: envCredentials{},
+		client:      http.DefaultClient,
 	}
 }
 
+// SetChunkSize sets the average size of the content-defined chunks archives are uploaded in,
+// archives are uploaded whole when it is 0, the default.
+func (n *CacheService) SetChunkSize(size int) {
+	n.chunkSize = size
+}
+
+// SetPartSize sets the size above which archives uploaded whole are split into numbered parts,
+// for proxies which limit the size of request bodies. Archives are never split when it is 0.
+func (n *CacheService) SetPartSize(size int64) {
+	n.partSize = size
+}
+
 func (n *CacheService) fetchJSON(url string, target any) error {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
 
-	username := os.Getenv("NEXUS_USERNAME")
-	secret := os.Getenv("NEXUS_SECRET")
-
-	req.SetBasicAuth(username, secret)
+	if err := n.authorize(req, false); err != nil {
+		return err
+	}
+	req, cancel := n.withTimeout(req)
+	defer cancel()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := n.client.Do(req)
 	if err != nil {
 		return err
 	}
 
 	content, err := io.ReadAll(resp.Body)
 	defer resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{Op: "get " + url, StatusCode: resp.StatusCode}
+	}
 
 	return json.Unmarshal(content, &target)
 }
 
-func (n *CacheService) uploadFile(url string, file *os.File) error {
+func (n *CacheService) uploadFile(url string, file io.Reader) error {
 	req, err := http.NewRequest("PUT", url, file)
 	if err != nil {
 		return err
 	}
-	username := os.Getenv("NEXUS_USERNAME")
-	secret := os.Getenv("NEXUS_SECRET")
-
-	req.SetBasicAuth(username, secret)
+	if section, ok := file.(*io.SectionReader); ok {
+		// sent with a length rather than chunked, proxies may refuse bodies of unknown size
+		req.ContentLength = section.Size()
+	}
+	if err := n.authorize(req, true); err != nil {
+		return err
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := n.client.Do(req)
 	if err != nil {
 		return err
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{Op: "upload " + url, StatusCode: resp.StatusCode}
+	}
 	return nil
 }
 
-func (n *CacheService) FindCache(keys []string, version string) (*Cache, error) {
-	searchKeys := make([]Search, 0)
-	searchKeys = append(searchKeys, Search{
-		key:       keys[0],
-		searchKey: fmt.Sprintf("%s/%s-%s", n.prefix, keys[0], version),
-	})
+// remove deletes an asset of the repository, an asset which is not there is not an error.
+func (n *CacheService) remove(path string) error {
+	req, err := http.NewRequest("DELETE", n.assetURL(path), nil)
+	if err != nil {
+		return err
+	}
+	if err := n.authorize(req, true); err != nil {
+		return err
+	}
+	req, cancel := n.withTimeout(req)
+	defer cancel()
 
-	for _, key := range keys[1:] {
-		searchKeys = append(searchKeys, Search{
-			key:       "",
-			searchKey: fmt.Sprintf("%s/%s*", n.prefix, key),
-		})
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return &StatusError{Op: "delete " + path, StatusCode: resp.StatusCode}
 	}
+	return nil
+}
 
-	for _, search := range searchKeys {
-		items := make([]SearchAssetItem, 0)
+// exists reports whether an asset exists in the repository.
+func (n *CacheService) exists(path string) (bool, error) {
+	req, err := http.NewRequest("HEAD", n.assetURL(path), nil)
+	if err != nil {
+		return false, err
+	}
+	if err := n.authorize(req, false); err != nil {
+		return false, err
+	}
+	req, cancel := n.withTimeout(req)
+	defer cancel()
 
-		key := search.searchKey
-		searchKeyUrl := fmt.Sprintf("%s/service/rest/v1/search/assets?repository=%s&format=raw&name=%s",
-			n.endPoint,
-			n.repository,
-			key,
-		)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, &StatusError{Op: "stat " + path, StatusCode: resp.StatusCode}
+	}
+}
 
-		for {
-			// run with search url above, also take not of continuationToken, iterate until none found
-			var searchResponse SearchAssetResponse
-			err := n.fetchJSON(searchKeyUrl, &searchResponse)
-			if err != nil {
-				return nil, err
-			}
+// Status checks that Nexus is up and serving reads, with the status endpoint of its REST API. It
+// is cheap enough to probe a Nexus which is believed to be down.
+func (n *CacheService) Status() error {
+	req, err := http.NewRequest("GET", n.endPoint+"/service/rest/v1/status", nil)
+	if err != nil {
+		return err
+	}
+	if err := n.authorize(req, false); err != nil {
+		return err
+	}
+	req, cancel := n.withTimeout(req)
+	defer cancel()
 
-			// parse response json into SearchAssetResponse
-			items = append(items, searchResponse.Items...)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Op: "status", StatusCode: resp.StatusCode}
+	}
+	return nil
+}
 
-			//Check if ContinuationToken is empty
-			if searchResponse.ContinuationToken == nil {
-				break
-			}
+// assetURL returns the URL of an asset of the repository.
+func (n *CacheService) assetURL(path string) string {
+	return fmt.Sprintf("%s/repository/%s/%s",
+		n.endPoint,
+		n.repository,
+		(&url.URL{Path: path}).EscapedPath(),
+	)
+}
 
-			// if continuationToken is not empty, append it to the URL for next fetch
-			searchKeyUrl = fmt.Sprintf("https://%s/service/rest/v1/search/assets?repository=%s&format=raw&name=%s*&continuationToken=%s",
-				n.endPoint,
-				n.repository,
-				key,
-				*searchResponse.ContinuationToken,
-			)
+// blobPath returns the path of the blob of an archive, blobs are shared by the refs of a namespace.
+func (n *CacheService) blobPath(namespace string, sha256 string) string {
+	return fmt.Sprintf("%s/blobs/sha256/%s", n.storePrefix(namespace, ""), sha256)
+}
+
+// storePrefix returns the path under which caches of a namespace and ref are stored,
+// the empty namespace stores directly under the prefix and the empty ref directly under the namespace.
+func (n *CacheService) storePrefix(namespace string, ref string) string {
+	prefix := n.prefix
+	if namespace != "" {
+		prefix = fmt.Sprintf("%s/repos/%s", prefix, namespace)
+	}
+	if ref != "" {
+		// git does not allow '~' in ref names, so flattening the ref into one segment is unambiguous
+		// and prefix searches in one ref never reach into another.
+		prefix = fmt.Sprintf("%s/refs/%s", prefix, strings.ReplaceAll(ref, "/", "~"))
+	}
+	return prefix
+}
+
+// Download opens an asset of the repository, the range is passed on as the Range header when set.
+// The caller must close the body of the response, which may be a 200 or a 206.
+func (n *CacheService) Download(path string, byteRange string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", n.assetURL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+
+	if err := n.authorize(req, false); err != nil {
+		return nil, err
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, &StatusError{Op: "download " + path, StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// Open opens the archive of a cache found by FindCache, following its Reference to the blob.
+// The range is passed on as the Range header when set. Only references record the digest of the
+// archive, assets uploaded in place are served unverified.
+func (n *CacheService) Open(path string, byteRange string) (*Object, error) {
+	if !strings.HasSuffix(path, referenceSuffix) {
+		resp, err := n.Download(path, byteRange)
+		if err != nil {
+			return nil, err
 		}
+		return &Object{Response: resp}, nil
+	}
 
-		// sort items based on LastModified, desc
-		sort.Slice(items, func(i, j int) bool {
-			return items[i].LastModified > items[j].LastModified
-		})
+	var reference Reference
+	if err := n.fetchJSON(n.assetURL(path), &reference); err != nil {
+		return nil, fmt.Errorf("read reference %s: %w", path, err)
+	}
+	return n.openReference(&reference, byteRange)
+}
 
-		if len(items) > 0 {
+// openReference opens the archive a Reference points at, the range is passed on as in Open.
+func (n *CacheService) openReference(reference *Reference, byteRange string) (*Object, error) {
+	if len(reference.Parts) > 0 {
+		return n.openParts(reference, byteRange)
+	}
+	resp, err := n.Download(reference.Blob, byteRange)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{
+		Response: resp,
+		Sha256:   reference.Sha256,
+	}, nil
+}
 
-			// return first item
-			// archiveLocation is item downladUrl
-			parsedUrl, err := url.Parse(items[0].DownloadUrl)
-			if err != nil {
-				return nil, err
+// Quarantine hides an asset which failed verification from lookups, by a marker uploaded next to
+// it so that every instance sharing the repository skips it until PutCache replaces it with a
+// sound archive. When the marker fails to upload, the asset is still hidden from this instance.
+func (n *CacheService) Quarantine(path string) error {
+	err := n.uploadFile(n.assetURL(path+quarantineSuffix), strings.NewReader(time.Now().UTC().Format(time.RFC3339)))
+	if err != nil {
+		n.quarantined.Store(path, true)
+	}
+	return err
+}
+
+// isQuarantined reports whether an asset failed verification, here or in an instance which left a
+// marker next to it among the found assets.
+func (n *CacheService) isQuarantined(found map[string]SearchAssetItem, path string) bool {
+	if _, ok := n.quarantined.Load(path); ok {
+		return true
+	}
+	_, ok := found[path+quarantineSuffix]
+	return ok
+}
+
+// quarantinedAsset reports whether a stored asset failed verification, here or in another instance.
+func (n *CacheService) quarantinedAsset(path string) (bool, error) {
+	if _, ok := n.quarantined.Load(path); ok {
+		return true, nil
+	}
+	return n.exists(path + quarantineSuffix)
+}
+
+// FindCache searches the refs in order for the keys, see findCache for the order within a ref.
+// Without refs only the caches which were stored without a ref are searched.
+func (n *CacheService) FindCache(namespace string, refs []string, keys []string, version string) (*Cache, error) {
+	if len(refs) == 0 {
+		return n.findCache(n.storePrefix(namespace, ""), keys, version)
+	}
+	for _, ref := range refs {
+		cache, err := n.findCache(n.storePrefix(namespace, ref), keys, version)
+		if err != nil || cache != nil {
+			return cache, err
+		}
+	}
+	return nil, nil
+}
+
+// findCache searches a store prefix for the keys, the cache is picked by match.Find like local
+// lookups do. Caches are picked by the key and version their names tell and the time their
+// Metadata sidecar was uploaded, the sidecar of the cache picked is read to make sure it describes
+// it. Caches uploaded before names were joined by nameSeparator fall back to the names of their
+// assets, which are <key>-<version> with a .ref suffix for references, their sidecars are not read.
+func (n *CacheService) findCache(prefix string, keys []string, version string) (*Cache, error) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		items, err := n.search(fmt.Sprintf("%s/%s*", prefix, encodeName(key)))
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]SearchAssetItem, len(items))
+		for _, item := range items {
+			found[strings.TrimPrefix(item.Path, "/")] = item
+		}
+
+		var assets []SearchAssetItem
+		var candidates []match.Candidate
+		// sidecars holds the sidecar of a candidate which is read once it is picked, or "" for the
+		// assets uploaded before sidecars
+		var sidecars []string
+		for _, item := range items {
+			path := strings.TrimPrefix(item.Path, "/")
+			if strings.HasSuffix(path, quarantineSuffix) || n.isQuarantined(found, path) {
+				continue
 			}
 
-			// if search.key is not empty
-			key = search.key
-			if key == "" {
-				// find key from item[0]
-				// items[0].Path is file path like
-				// get the file
-				filename := filepath.Base(items[0].Path)
-				lastIndex := strings.LastIndex(filename, "-")
-				key = filename[:lastIndex]
+			if storeKey, ok := strings.CutSuffix(path, metadataSuffix); ok {
+				name, ok := strings.CutPrefix(storeKey, prefix+"/")
+				if !ok || strings.Contains(name, "/") {
+					// a cache of another repository or ref stored below the prefix
+					continue
+				}
+				asset, ok := n.metadataAsset(found, storeKey)
+				if !ok {
+					continue
+				}
+				cacheKey, cacheVersion, err := parseAssetName(name)
+				if err != nil || cacheVersion != version {
+					continue
+				}
+				// the name tells the key and version, only the sidecar of the cache picked is read
+				created, _ := time.Parse(time.RFC3339Nano, item.LastModified)
+				assets = append(assets, asset)
+				candidates = append(candidates, match.Candidate{
+					Key:     cacheKey,
+					Version: version,
+					Created: created,
+				})
+				sidecars = append(sidecars, path)
+				continue
+			}
+
+			storeKey := strings.TrimSuffix(path, referenceSuffix)
+			if _, ok := found[storeKey+metadataSuffix]; ok && strings.Contains(strings.TrimPrefix(storeKey, prefix+"/"), nameSeparator) {
+				// resolved through its sidecar
+				continue
+			}
+			cacheKey, ok := assetKey(prefix, path, version)
+			if !ok {
+				continue
 			}
+			created, _ := time.Parse(time.RFC3339Nano, item.LastModified)
+			assets = append(assets, item)
+			candidates = append(candidates, match.Candidate{
+				Key:     cacheKey,
+				Version: version,
+				Created: created,
+			})
+			sidecars = append(sidecars, "")
+		}
 
+		for {
+			i := match.Find([]string{key}, version, candidates)
+			if i < 0 {
+				break
+			}
+			if sidecars[i] != "" {
+				metadata, err := n.readMetadata(sidecars[i])
+				if err != nil {
+					return nil, err
+				}
+				storeKey := strings.TrimSuffix(sidecars[i], metadataSuffix)
+				if metadata.Key != candidates[i].Key || !describes(metadata, assets[i], storeKey, version) {
+					assets = slices.Delete(assets, i, i+1)
+					candidates = slices.Delete(candidates, i, i+1)
+					sidecars = slices.Delete(sidecars, i, i+1)
+					continue
+				}
+			}
+			// archiveLocation is item downladUrl
+			parsedUrl, err := url.Parse(assets[i].DownloadUrl)
+			if err != nil {
+				return nil, err
+			}
 			return &Cache{
-				ArchiveLocation: strings.ReplaceAll(items[0].DownloadUrl,
+				ArchiveLocation: strings.ReplaceAll(assets[i].DownloadUrl,
 					fmt.Sprintf("%s://%s", parsedUrl.Scheme, parsedUrl.Host),
 					n.endPoint,
 				),
-				CacheKey: key,
+				CacheKey: candidates[i].Key,
+				Path:     strings.TrimPrefix(assets[i].Path, "/"),
 			}, nil
 		}
 	}
@@ -179,20 +495,191 @@ func (n *CacheService) FindCache(keys []string, version string) (*Cache, error)
 	return nil, nil
 }
 
-func (n *CacheService) PutCache(key string, version string, filename string) {
-	storeKey := fmt.Sprintf("%s/%s-%s", n.prefix, key, version)
-	searchKeyUrl := fmt.Sprintf("%s/repository/%s/%s",
-		n.endPoint,
-		n.repository,
-		storeKey,
-	)
+// describes reports whether a sidecar describes the asset of its store key, a reference or an
+// archive uploaded in place of the size recorded.
+func describes(metadata *Metadata, asset SearchAssetItem, storeKey string, version string) bool {
+	return metadata.Version == version && (asset.Path == storeKey+referenceSuffix || int64(asset.FileSize) == metadata.Size)
+}
+
+// metadataAsset returns the asset of the found ones which a sidecar describes, the reference of
+// its key or the archive uploaded in place. The path of the asset is trimmed of its leading slash.
+func (n *CacheService) metadataAsset(found map[string]SearchAssetItem, storeKey string) (SearchAssetItem, bool) {
+	for _, path := range []string{storeKey + referenceSuffix, storeKey} {
+		asset, ok := found[path]
+		if !ok {
+			continue
+		}
+		if n.isQuarantined(found, path) {
+			return SearchAssetItem{}, false
+		}
+		asset.Path = path
+		return asset, true
+	}
+	return SearchAssetItem{}, false
+}
+
+// assetKey returns the cache key of an asset found under a store prefix, ok is false when the
+// asset is not a cache of the version, like checksum sidecars, blobs, and the caches of other
+// refs and repositories stored below the prefix, whose names never decode as they hold a '/'.
+func assetKey(prefix string, path string, version string) (string, bool) {
+	name, ok := strings.CutPrefix(path, prefix+"/")
+	if !ok {
+		return "", false
+	}
+	name = strings.TrimSuffix(name, referenceSuffix)
+	if key, v, err := parseAssetName(name); err == nil {
+		return key, v == version
+	}
+	name, ok = strings.CutSuffix(name, legacySeparator+encodeName(version))
+	if !ok {
+		return "", false
+	}
+	key, err := decodeName(name)
+	return key, err == nil
+}
+
+// search lists the assets of the repository matching a name, which may end with a wildcard.
+func (n *CacheService) search(name string) ([]SearchAssetItem, error) {
+	items := make([]SearchAssetItem, 0)
+
+	query := url.Values{}
+	query.Set("repository", n.repository)
+	query.Set("format", "raw")
+	query.Set("name", name)
+
+	for {
+		// run with search url above, also take not of continuationToken, iterate until none found
+		var searchResponse SearchAssetResponse
+		err := n.fetchJSON(fmt.Sprintf("%s/service/rest/v1/search/assets?%s", n.endPoint, query.Encode()), &searchResponse)
+		if err != nil {
+			return nil, err
+		}
+
+		// parse response json into SearchAssetResponse
+		items = append(items, searchResponse.Items...)
+
+		//Check if ContinuationToken is empty
+		if searchResponse.ContinuationToken == nil {
+			break
+		}
+
+		// if continuationToken is not empty, the same search continues with it
+		query.Set("continuationToken", *searchResponse.ContinuationToken)
+	}
+	return items, nil
+}
+
+// PutCache uploads the file to the blob of its sha256 unless the blob, or the list of its parts,
+// is already there, as content-defined chunks when chunking is enabled, or as numbered parts of
+// the blob when it is larger than the part size, then points the cache key at it with a Reference
+// and records its Metadata next to it. Without a sha256 the file is uploaded in place. A key which
+// is already stored is never overwritten unless quarantined, ErrCacheExists is returned instead. A
+// quarantined key is replaced along with its blob, which may be the corrupt part, and its markers
+// are removed.
+func (n *CacheService) PutCache(namespace string, ref string, key string, version string, filename string, sha256 string) error {
+	storeKey := n.storePrefix(namespace, ref) + "/" + assetName(key, version)
+	var quarantined []string
+	for _, path := range []string{storeKey + referenceSuffix, storeKey} {
+		if ok, err := n.exists(path); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if ok, err := n.quarantinedAsset(path); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("%s: %w", path, ErrCacheExists)
+		}
+		// failed verification, a sound archive replaces it
+		quarantined = append(quarantined, path)
+	}
 
 	// upload file on filename to nexus
 	file, err := os.Open(filename)
 	if err != nil {
-		// handle error
+		return err
 	}
 	defer file.Close()
 
-	n.uploadFile(searchKeyUrl, file)
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	metadata := &Metadata{
+		Key:       key,
+		Version:   version,
+		Size:      info.Size(),
+		Sha256:    sha256,
+		CreatedAt: time.Now().UTC(),
+		Creator:   n.creator,
+	}
+
+	if sha256 == "" {
+		if err := n.uploadFile(n.assetURL(storeKey), file); err != nil {
+			return err
+		}
+		if err := n.putMetadata(storeKey, metadata); err != nil {
+			return err
+		}
+		return n.release(quarantined)
+	}
+
+	reference := Reference{
+		Blob:   n.blobPath(namespace, sha256),
+		Sha256: sha256,
+		Size:   info.Size(),
+	}
+	// the blob of a quarantined key may be what failed verification, it is uploaded again
+	ok := false
+	if len(quarantined) == 0 {
+		if ok, err = n.exists(reference.Blob); err != nil {
+			return err
+		}
+	}
+	if !ok && len(quarantined) == 0 {
+		if reference.Parts, err = n.storedParts(reference.Blob, info.Size()); err != nil {
+			return err
+		}
+		if ok = len(reference.Parts) > 0; ok {
+			reference.Blob = ""
+		}
+	}
+	if !ok && n.chunkSize > 0 {
+		reference.Blob = ""
+		if reference.Parts, err = n.putChunks(namespace, file); err != nil {
+			return err
+		}
+	} else if !ok && n.partSize > 0 && info.Size() > n.partSize {
+		if reference.Parts, err = n.putParts(reference.Blob, file, info.Size()); err != nil {
+			return err
+		}
+		reference.Blob = ""
+	} else if !ok {
+		if err := n.uploadFile(n.assetURL(reference.Blob), file); err != nil {
+			return err
+		}
+	}
+
+	content, err := json.Marshal(reference)
+	if err != nil {
+		return err
+	}
+	if err := n.uploadFile(n.assetURL(storeKey+referenceSuffix), bytes.NewReader(content)); err != nil {
+		return err
+	}
+	if err := n.putMetadata(storeKey, metadata); err != nil {
+		return err
+	}
+	return n.release(quarantined)
+}
+
+// release lifts the quarantine of assets a sound archive replaced.
+func (n *CacheService) release(paths []string) error {
+	for _, path := range paths {
+		if err := n.remove(path + quarantineSuffix); err != nil {
+			return err
+		}
+		n.quarantined.Delete(path)
+	}
+	return nil
 }
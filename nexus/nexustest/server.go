@@ -0,0 +1,376 @@
+// Package nexustest provides an in-process fake of a Nexus Repository Manager raw hosted
+// repository, for the contract tests of CacheService.
+package nexustest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPageSize is how many assets a search returns per page, Nexus returns 50.
+const defaultPageSize = 50
+
+// Fault makes requests matching a method and a path prefix fail, Times requests in a row or for
+// as long as Times is negative. A fault either answers with Status, or when Truncate is set cuts
+// the body of a successful response short after half of it.
+type Fault struct {
+	Method   string
+	Prefix   string
+	Status   int
+	Truncate bool
+	Times    int
+}
+
+type asset struct {
+	content  []byte
+	modified time.Time
+}
+
+// Server is a fake Nexus serving a single raw hosted repository: PUT, GET with ranges, HEAD and
+// DELETE of assets below /repository/<name>/, and the paged asset search of the REST API.
+type Server struct {
+	*httptest.Server
+	repository string
+
+	mu       sync.Mutex
+	assets   map[string]*asset
+	pageSize int
+	latency  time.Duration
+	faults   []*Fault
+	requests []string
+
+	// credentials are required when set, reads also pass without them when anonymousRead is set.
+	username      string
+	password      string
+	auth          bool
+	anonymousRead bool
+}
+
+// NewServer starts a fake Nexus with an empty repository, it must be closed when done.
+func NewServer(repository string) *Server {
+	s := &Server{
+		repository: repository,
+		assets:     map[string]*asset{},
+		pageSize:   defaultPageSize,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// StoreEndpoint returns the URL of a prefix of the repository, as NewCacheService takes it.
+func (s *Server) StoreEndpoint(prefix string) string {
+	return s.URL + "/repository/" + s.repository + "/" + prefix
+}
+
+// SetPageSize sets how many assets a search returns per page.
+func (s *Server) SetPageSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pageSize = size
+}
+
+// SetLatency delays every request.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// SetCredentials requires basic authentication with the username and password, reads are
+// allowed without credentials when anonymousRead is set.
+func (s *Server) SetCredentials(username string, password string, anonymousRead bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username, s.password, s.auth, s.anonymousRead = username, password, true, anonymousRead
+}
+
+// Inject adds a fault, faults are matched in the order they were added.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// Requests returns the method and path of every request served so far.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Assets returns the paths of the assets of the repository, sorted.
+func (s *Server) Assets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, 0, len(s.assets))
+	for p := range s.assets {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Content returns the content of an asset, ok is false when there is none.
+func (s *Server) Content(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.assets[path]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), a.content...), true
+}
+
+// Corrupt flips a byte of an asset.
+func (s *Server) Corrupt(path string, offset int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.assets[path]
+	if !ok || offset >= len(a.content) {
+		return false
+	}
+	a.content[offset] ^= 0xff
+	return true
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	latency := s.latency
+	fault := s.fault(r)
+	authorized := s.authorized(r)
+	s.mu.Unlock()
+
+	time.Sleep(latency)
+	if !authorized {
+		w.Header().Set("WWW-Authenticate", `BASIC realm="Sonatype Nexus Repository Manager"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if fault != nil && fault.Status != 0 {
+		http.Error(w, "injected fault", fault.Status)
+		return
+	}
+	if fault != nil && fault.Truncate {
+		w = &truncatingWriter{ResponseWriter: w}
+	}
+
+	if r.URL.Path == "/service/rest/v1/status" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.URL.Path == "/service/rest/v1/search/assets" && r.Method == http.MethodGet {
+		s.search(w, r)
+		return
+	}
+	assetPath, ok := strings.CutPrefix(r.URL.Path, "/repository/"+s.repository+"/")
+	if !ok || assetPath == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.get(w, r, assetPath)
+	case http.MethodPut:
+		s.put(w, r, assetPath)
+	case http.MethodDelete:
+		s.delete(w, assetPath)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// fault returns the fault a request runs into, if any, and counts it down.
+func (s *Server) fault(r *http.Request) *Fault {
+	for _, f := range s.faults {
+		if f.Times == 0 || f.Method != "" && f.Method != r.Method || !strings.HasPrefix(r.URL.Path, f.Prefix) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+		}
+		return f
+	}
+	return nil
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if !s.auth {
+		return true
+	}
+	if s.anonymousRead && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	return ok && username == s.username && password == s.password
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, assetPath string) {
+	s.mu.Lock()
+	a, ok := s.assets[assetPath]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", a.modified, bytes.NewReader(a.content))
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, assetPath string) {
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.assets[assetPath] = &asset{content: content, modified: time.Now().UTC()}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) delete(w http.ResponseWriter, assetPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.assets[assetPath]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	delete(s.assets, assetPath)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type searchItem struct {
+	DownloadUrl  string            `json:"downloadUrl"`
+	Path         string            `json:"path"`
+	Id           string            `json:"id"`
+	Repository   string            `json:"repository"`
+	Format       string            `json:"format"`
+	Checksum     map[string]string `json:"checksum"`
+	ContentType  string            `json:"contentType"`
+	LastModified string            `json:"lastModified"`
+	FileSize     int               `json:"fileSize"`
+}
+
+// search answers the asset search, name matches the path of an asset with '*' as a wildcard. The
+// continuation token is the offset of the next page.
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("repository") != s.repository || query.Get("format") != "raw" {
+		writeJSON(w, map[string]any{"items": []searchItem{}, "continuationToken": nil})
+		return
+	}
+	offset := 0
+	if token := query.Get("continuationToken"); token != "" {
+		var err error
+		if offset, err = strconv.Atoi(token); err != nil || offset < 0 {
+			http.Error(w, "invalid continuation token", http.StatusBadRequest)
+			return
+		}
+	}
+	name := query.Get("name")
+
+	s.mu.Lock()
+	var paths []string
+	for p := range s.assets {
+		if matchName(name, p) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	end := min(offset+s.pageSize, len(paths))
+	var items []searchItem
+	for _, p := range paths[min(offset, end):end] {
+		a := s.assets[p]
+		sha1sum, sha256sum, md5sum := sha1.Sum(a.content), sha256.Sum256(a.content), md5.Sum(a.content)
+		items = append(items, searchItem{
+			DownloadUrl: s.URL + "/repository/" + s.repository + "/" + (&url.URL{Path: p}).EscapedPath(),
+			Path:        p,
+			Id:          p,
+			Repository:  s.repository,
+			Format:      "raw",
+			Checksum: map[string]string{
+				"sha1":   hex.EncodeToString(sha1sum[:]),
+				"sha256": hex.EncodeToString(sha256sum[:]),
+				"md5":    hex.EncodeToString(md5sum[:]),
+			},
+			ContentType:  "application/octet-stream",
+			LastModified: a.modified.Format("2006-01-02T15:04:05.000-07:00"),
+			FileSize:     len(a.content),
+		})
+	}
+	s.mu.Unlock()
+
+	response := map[string]any{"items": items, "continuationToken": nil}
+	if end < len(paths) {
+		response["continuationToken"] = strconv.Itoa(end)
+	}
+	if items == nil {
+		response["items"] = []searchItem{}
+	}
+	writeJSON(w, response)
+}
+
+// matchName reports whether the path of an asset matches a search name, in which '*' matches any
+// run of characters, '/' included, like it does in Nexus.
+func matchName(name string, assetPath string) bool {
+	literal, rest, wildcard := strings.Cut(name, "*")
+	if !wildcard {
+		return name == assetPath
+	}
+	if !strings.HasPrefix(assetPath, literal) {
+		return false
+	}
+	assetPath = assetPath[len(literal):]
+	for i := 0; i <= len(assetPath); i++ {
+		if matchName(rest, assetPath[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// truncatingWriter sends the headers of a response but only half of its body, so the client
+// runs into an unexpected EOF.
+type truncatingWriter struct {
+	http.ResponseWriter
+	limit   int64
+	written int64
+}
+
+func (t *truncatingWriter) WriteHeader(status int) {
+	if length, err := strconv.ParseInt(t.Header().Get("Content-Length"), 10, 64); err == nil {
+		t.limit = length / 2
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *truncatingWriter) Write(b []byte) (int, error) {
+	if t.written+int64(len(b)) > t.limit {
+		n, _ := t.ResponseWriter.Write(b[:max(t.limit-t.written, 0)])
+		t.written += int64(n)
+		// the server closes the connection when the body is shorter than its length
+		return len(b), nil
+	}
+	n, err := t.ResponseWriter.Write(b)
+	t.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,281 @@
+package nexus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Part is a piece of an archive stored as an asset of its own, Reference.Parts lists them in order.
+type Part struct {
+	Path   string `json:"path"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// chunkPath returns the path of a content-defined chunk, chunks are shared by the refs of a namespace.
+func (n *CacheService) chunkPath(namespace string, sha256 string) string {
+	return fmt.Sprintf("%s/chunks/sha256/%s", n.storePrefix(namespace, ""), sha256)
+}
+
+// putChunks splits the archive into content-defined chunks and uploads the ones the repository
+// does not have yet, so an archive which changed a little only uploads the chunks around the changes.
+func (n *CacheService) putChunks(namespace string, r io.Reader) ([]Part, error) {
+	var parts []Part
+	chunks := newChunker(r, n.chunkSize)
+	for {
+		chunk, err := chunks.Next()
+		if errors.Is(err, io.EOF) {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(chunk)
+		digest := hex.EncodeToString(sum[:])
+		part := Part{
+			Path:   n.chunkPath(namespace, digest),
+			Sha256: digest,
+			Size:   int64(len(chunk)),
+		}
+		if ok, err := n.exists(part.Path); err != nil {
+			return nil, err
+		} else if !ok {
+			if err := n.uploadFile(n.assetURL(part.Path), bytes.NewReader(chunk)); err != nil {
+				return nil, err
+			}
+		}
+		parts = append(parts, part)
+	}
+}
+
+// partsSuffix is appended to the path of a blob stored in parts for the list of its parts, which
+// is uploaded once every part is, so that archives uploaded again share the parts.
+const partsSuffix = ".parts"
+
+// partPath returns the path of a numbered part of a blob.
+func partPath(blob string, index int) string {
+	return fmt.Sprintf("%s.part%04d", blob, index)
+}
+
+// putParts uploads an archive too large for a single request as numbered parts of its blob. Parts
+// are named after the blob, so the parts an interrupted upload left behind are not uploaded again.
+func (n *CacheService) putParts(blob string, file io.ReaderAt, size int64) ([]Part, error) {
+	var parts []Part
+	for offset, index := int64(0), 1; offset < size; offset, index = offset+n.partSize, index+1 {
+		length := min(n.partSize, size-offset)
+		hash := sha256.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(file, offset, length)); err != nil {
+			return nil, err
+		}
+		part := Part{
+			Path:   partPath(blob, index),
+			Sha256: hex.EncodeToString(hash.Sum(nil)),
+			Size:   length,
+		}
+		if ok, err := n.exists(part.Path); err != nil {
+			return nil, err
+		} else if !ok {
+			if err := n.uploadFile(n.assetURL(part.Path), io.NewSectionReader(file, offset, length)); err != nil {
+				return nil, err
+			}
+		}
+		parts = append(parts, part)
+	}
+	content, err := json.Marshal(parts)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.uploadFile(n.assetURL(blob+partsSuffix), bytes.NewReader(content)); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// storedParts returns the parts of a blob of the size stored in parts, or nil when it is not.
+func (n *CacheService) storedParts(blob string, size int64) ([]Part, error) {
+	var parts []Part
+	var statusErr *StatusError
+	if err := n.fetchJSON(n.assetURL(blob+partsSuffix), &parts); errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read parts of %s: %w", blob, err)
+	}
+	var total int64
+	for _, part := range parts {
+		total += part.Size
+	}
+	if total != size {
+		return nil, nil
+	}
+	return parts, nil
+}
+
+// openParts opens the archive of a reference stored in parts as if it was a single asset,
+// answering a range the way Nexus would.
+func (n *CacheService) openParts(reference *Reference, byteRange string) (*Object, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Accept-Ranges", "bytes")
+
+	status := http.StatusOK
+	start, end, ok := parseRange(byteRange, reference.Size)
+	if ok {
+		status = http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, reference.Size))
+	} else {
+		start, end = 0, reference.Size-1
+	}
+	length := end - start + 1
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+
+	// skip the parts before the range
+	parts := reference.Parts
+	for len(parts) > 0 && start >= parts[0].Size {
+		start -= parts[0].Size
+		parts = parts[1:]
+	}
+
+	return &Object{
+		Response: &http.Response{
+			Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode:    status,
+			Header:        header,
+			ContentLength: length,
+			Body: &partReader{
+				n:      n,
+				parts:  parts,
+				offset: start,
+				remain: length,
+			},
+		},
+		Sha256: reference.Sha256,
+	}, nil
+}
+
+// parseRange parses a Range header of a single range like Nexus supports, ok is false when the
+// header is empty or is not satisfiable, the whole archive is served then.
+func parseRange(byteRange string, size int64) (start int64, end int64, ok bool) {
+	spec, found := strings.CutPrefix(byteRange, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, _ := strings.Cut(spec, "-")
+	var err error
+	switch {
+	case first == "":
+		// the last bytes of the archive
+		var suffix int64
+		if suffix, err = strconv.ParseInt(last, 10, 64); err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		start, end = max(size-suffix, 0), size-1
+	case last == "":
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+			return 0, 0, false
+		}
+		end = size - 1
+	default:
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+			return 0, 0, false
+		}
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	if start < 0 || start > end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// partReader reads a range of an archive stored in parts, downloading the parts it spans one
+// after the other.
+type partReader struct {
+	n     *CacheService
+	parts []Part
+	// offset is where the range starts in the first part, remain how much of it is left to read.
+	offset int64
+	remain int64
+
+	// body is the current part, left how much of it is left to read
+	path string
+	body io.ReadCloser
+	left int64
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	for p.remain > 0 {
+		if p.body == nil {
+			if err := p.next(); err != nil {
+				return 0, err
+			}
+		}
+		if p.left == 0 {
+			p.body.Close()
+			p.body = nil
+			continue
+		}
+
+		n, err := p.body.Read(b[:min(int64(len(b)), p.left)])
+		p.left -= int64(n)
+		p.remain -= int64(n)
+		if errors.Is(err, io.EOF) && p.left > 0 {
+			return n, fmt.Errorf("read part %s: %w", p.path, io.ErrUnexpectedEOF)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+// next opens the part the range continues in.
+func (p *partReader) next() error {
+	if len(p.parts) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	part := p.parts[0]
+	p.parts = p.parts[1:]
+
+	length := min(part.Size-p.offset, p.remain)
+	byteRange := ""
+	if length < part.Size {
+		byteRange = fmt.Sprintf("bytes=%d-%d", p.offset, p.offset+length-1)
+	}
+	resp, err := p.n.Download(part.Path, byteRange)
+	if err != nil {
+		return err
+	}
+	if byteRange != "" && resp.StatusCode == http.StatusOK {
+		// the range was ignored
+		if _, err := io.CopyN(io.Discard, resp.Body, p.offset); err != nil {
+			resp.Body.Close()
+			return fmt.Errorf("read part %s: %w", part.Path, err)
+		}
+	}
+	p.path = part.Path
+	p.body = resp.Body
+	p.offset = 0
+	p.left = length
+	return nil
+}
+
+func (p *partReader) Close() error {
+	if p.body != nil {
+		return p.body.Close()
+	}
+	return nil
+}